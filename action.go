@@ -1,6 +1,8 @@
 package peco
 
 import (
+	"fmt"
+	"time"
 	"unicode"
 
 	"github.com/nsf/termbox-go"
@@ -77,6 +79,9 @@ func init() {
 	ActionFunc(doKillEndOfLine).Register("KillEndOfLine", termbox.KeyCtrlK)
 	ActionFunc(doKillBeginningOfLine).Register("KillBeginningOfLine", termbox.KeyCtrlU)
 	ActionFunc(doRotateMatcher).Register("RotateMatcher", termbox.KeyCtrlR)
+	ActionFunc(doToggleRanking).Register("ToggleRanking")
+	ActionFunc(doToggleContext).Register("ToggleContext")
+	ActionFunc(doReload).Register("Reload")
 
 	ActionFunc(doSelectUp).Register("SelectUp", termbox.KeyArrowUp, termbox.KeyCtrlP)
 	ActionFunc(func(i *Input, ev termbox.Event) {
@@ -124,6 +129,9 @@ func init() {
 	ActionFunc(doToggleRangeMode).Register("ToggleRangeMode")
 	ActionFunc(doCancelRangeMode).Register("CancelRangeMode")
 	ActionFunc(doToggleQuery).Register("ToggleQuery", termbox.KeyCtrlT)
+	ActionFunc(doHistoryPrevious).Register("HistoryPrevious")
+	ActionFunc(doHistoryNext).Register("HistoryNext")
+	ActionFunc(doHistorySearch).Register("HistorySearch")
 	ActionFunc(doRefreshScreen).Register("RefreshScreen", termbox.KeyCtrlL)
 
 	ActionFunc(doKonamiCommand).RegisterKeySequence(
@@ -153,6 +161,14 @@ func doAcceptChar(i *Input, ev termbox.Event) {
 		ev.Ch = ' '
 	}
 
+	if ev.Ch > 0 && isHistorySearch(i) {
+		term := i.history.SearchTerm() + string(ev.Ch)
+		searchHistory(i, func() (string, bool) {
+			return i.history.SetSearchTerm(term)
+		})
+		return
+	}
+
 	if ev.Ch > 0 {
 		if i.QueryLen() == i.CaretPos() {
 			i.AppendQuery(ev.Ch)
@@ -173,12 +189,55 @@ func doRotateMatcher(i *Input, ev termbox.Event) {
 	i.DrawMatches(nil)
 }
 
+func doToggleContext(i *Input, ev termbox.Event) {
+	if n := i.ToggleContext(); n > 0 {
+		i.SendStatusMsgAndClear(fmt.Sprintf("Showing %d lines of context", n), 500*time.Millisecond)
+	} else {
+		i.SendStatusMsgAndClear("Hiding context lines", 500*time.Millisecond)
+	}
+
+	// The positions of the matches are only looked up when context
+	// lines are displayed, so the query must run again
+	if i.ExecQuery() {
+		return
+	}
+	i.DrawMatches(nil)
+}
+
+func doReload(i *Input, ev termbox.Event) {
+	i.SendStatusMsg("Reloading...")
+
+	// Don't keep the user waiting while the command runs
+	go func() {
+		if err := i.Reload(); err != nil {
+			i.SendStatusMsg(err.Error())
+			return
+		}
+		i.SendStatusMsgAndClear("Reloaded", 500*time.Millisecond)
+	}()
+}
+
+func doToggleRanking(i *Input, ev termbox.Event) {
+	enabled := !i.IsRankingEnabled()
+	i.SetRankingEnabled(enabled)
+	if enabled {
+		i.SendStatusMsgAndClear("Ranking results by match quality", 500*time.Millisecond)
+	} else {
+		i.SendStatusMsgAndClear("Showing results in input order", 500*time.Millisecond)
+	}
+
+	if i.ExecQuery() {
+		return
+	}
+	i.DrawMatches(nil)
+}
+
 func doToggleSelection(i *Input, _ termbox.Event) {
-	if i.selection.Has(i.currentLine) {
-		i.selection.Remove(i.currentLine)
+	if i.SelectionContains(i.currentLine) {
+		i.SelectionRemove(i.currentLine)
 		return
 	}
-	i.selection.Add(i.currentLine)
+	i.SelectionAdd(i.currentLine)
 }
 
 func doToggleRangeMode(i *Input, _ termbox.Event) {
@@ -186,7 +245,7 @@ func doToggleRangeMode(i *Input, _ termbox.Event) {
 		i.selectionRangeStart = invalidSelectionRange
 	} else {
 		i.selectionRangeStart = i.currentLine
-		i.SelectionAdd(i.currentPage.offset + i.currentLine)
+		i.SelectionAdd(i.currentLine)
 	}
 	i.DrawMatches(nil)
 }
@@ -197,13 +256,13 @@ func doCancelRangeMode(i *Input, _ termbox.Event) {
 }
 
 func doSelectNone(i *Input, _ termbox.Event) {
-	i.selection.Clear()
+	i.SelectionClear()
 	i.DrawMatches(nil)
 }
 
 func doSelectAll(i *Input, _ termbox.Event) {
-	for lineno := 1; lineno <= len(i.current); lineno++ {
-		i.selection.Add(lineno)
+	for lineno := 1; lineno <= i.GetCurrentLen(); lineno++ {
+		i.SelectionAdd(lineno)
 	}
 	i.DrawMatches(nil)
 }
@@ -212,7 +271,7 @@ func doSelectVisible(i *Input, _ termbox.Event) {
 	pageStart := i.currentPage.offset
 	pageEnd := pageStart + i.currentPage.perPage
 	for lineno := pageStart; lineno <= pageEnd; lineno++ {
-		i.selection.Add(lineno)
+		i.SelectionAdd(lineno)
 	}
 	i.DrawMatches(nil)
 }
@@ -223,16 +282,26 @@ func doFinish(i *Input, _ termbox.Event) {
 		i.SelectionAdd(i.currentLine)
 	}
 
+	// Failing to save the history is not worth bothering the user
+	// with, as we're about to exit
+	if i.history != nil {
+		i.history.Add(i.QueryString())
+	}
+
 	i.resultCh = make(chan Line)
 	go func() {
-		max := i.GetCurrentLen()
-		for x := 1; x <= max; x++ {
-			if x > i.GetCurrentLen() {
-				break
+		// The selected lines that are displayed come first, in their
+		// order on the screen, followed by those that the query hides
+		done := make(map[uint64]bool)
+		for _, l := range i.GetCurrent() {
+			if i.IsSelected(l) {
+				done[l.ID()] = true
+				i.resultCh <- l
 			}
-
-			if i.selection.Has(x) {
-				i.resultCh <- i.GetCurrentAt(x - 1)
+		}
+		for _, l := range i.selection.Lines() {
+			if !done[l.ID()] {
+				i.resultCh <- l
 			}
 		}
 		close(i.resultCh)
@@ -247,6 +316,12 @@ func doCancel(i *Input, ev termbox.Event) {
 		return
 	}
 
+	if isHistorySearch(i) {
+		i.SendStatusMsg("")
+		setQueryFromHistory(i, i.history.CancelSearch())
+		return
+	}
+
 	if i.IsRangeMode() {
 		doCancelRangeMode(i, ev)
 		return
@@ -289,7 +364,7 @@ func doToggleSelectionAndSelectNext(i *Input, ev termbox.Event) {
 }
 
 func doInvertSelection(i *Input, _ termbox.Event) {
-	i.selection.Invert(i.GetCurrentLen())
+	i.selection.Invert(i.GetCurrent())
 	i.DrawMatches(nil)
 }
 
@@ -529,6 +604,17 @@ func doDeleteForwardChar(i *Input, _ termbox.Event) {
 }
 
 func doDeleteBackwardChar(i *Input, ev termbox.Event) {
+	if isHistorySearch(i) {
+		term := []rune(i.history.SearchTerm())
+		if len(term) > 0 {
+			term = term[:len(term)-1]
+		}
+		searchHistory(i, func() (string, bool) {
+			return i.history.SetSearchTerm(string(term))
+		})
+		return
+	}
+
 	if i.QueryLen() <= 0 {
 		return
 	}
@@ -581,6 +667,82 @@ func doToggleQuery(i *Input, _ termbox.Event) {
 	i.DrawMatches(nil)
 }
 
+// setQueryFromHistory replaces the query with one from the history
+func setQueryFromHistory(i *Input, q string) {
+	i.SetQuery([]rune(q))
+	if i.ExecQuery() {
+		return
+	}
+	i.SetCurrent(nil)
+	i.DrawMatches(nil)
+}
+
+func doHistoryPrevious(i *Input, _ termbox.Event) {
+	if i.history == nil {
+		return
+	}
+	if i.history.Searching() {
+		searchHistory(i, i.history.SearchOlder)
+		return
+	}
+	if q, ok := i.history.Previous(i.QueryString()); ok {
+		setQueryFromHistory(i, q)
+	}
+}
+
+func doHistoryNext(i *Input, _ termbox.Event) {
+	if i.history == nil {
+		return
+	}
+	if i.history.Searching() {
+		searchHistory(i, i.history.SearchNewer)
+		return
+	}
+	if q, ok := i.history.Next(i.QueryString()); ok {
+		setQueryFromHistory(i, q)
+	}
+}
+
+// doHistorySearch starts an incremental search in the history for the
+// query that was typed, or goes on to an older match. While searching,
+// typing changes what is searched for, and peco.Cancel puts back the
+// query that was typed
+func doHistorySearch(i *Input, _ termbox.Event) {
+	if i.history == nil {
+		return
+	}
+	if !i.history.Searching() {
+		i.history.StartSearch(i.QueryString())
+	}
+	searchHistory(i, i.history.SearchOlder)
+}
+
+// searchHistory runs a step of the history search, and puts the entry
+// that was found in the prompt
+func searchHistory(i *Input, search func() (string, bool)) {
+	i.searchKept = true
+	q, ok := search()
+	if !ok {
+		i.SendStatusMsg("History search (no match): " + i.history.SearchTerm())
+		return
+	}
+	i.SendStatusMsg("History search: " + i.history.SearchTerm())
+	setQueryFromHistory(i, q)
+}
+
+// endHistorySearch ends the history search, if there is one, keeping
+// the query that was found
+func endHistorySearch(i *Input) {
+	if i.history != nil && i.history.EndSearch() {
+		i.SendStatusMsg("")
+	}
+}
+
+// isHistorySearch returns true while a history search is going on
+func isHistorySearch(i *Input) bool {
+	return i.history != nil && i.history.Searching()
+}
+
 func doKonamiCommand(i *Input, ev termbox.Event) {
 	i.SendStatusMsg("All your filters are belongs to us")
 }
@@ -1,6 +1,10 @@
 package peco
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/mattn/go-runewidth"
@@ -164,3 +168,94 @@ func TestDoDeleteBackwardWord(t *testing.T) {
 	expectQueryString(t, ctx, "foo ")
 	expectCaretPos(t, ctx, 4)
 }
+
+func TestDoHistorySearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewCtx(nil)
+	drainChannels(ctx, nil)
+	go func() {
+		for {
+			select {
+			case <-ctx.LoopCh():
+				return
+			case <-ctx.QueryCh():
+			}
+		}
+	}()
+	defer ctx.Stop()
+
+	h := NewHistory(filepath.Join(dir, "history"), "")
+	for _, q := range []string{"bar", "foo bar", "baz", "foo"} {
+		if err := h.Add(q); err != nil {
+			t.Fatalf("Failed to add to history: %s", err)
+		}
+	}
+	ctx.history = h
+	input := ctx.NewInput()
+	ctx.SetQuery([]rune("ba"))
+
+	doHistorySearch(input, termbox.Event{})
+	expectQueryString(t, ctx, "baz")
+	doHistorySearch(input, termbox.Event{})
+	expectQueryString(t, ctx, "foo bar")
+	doHistorySearch(input, termbox.Event{})
+	expectQueryString(t, ctx, "bar")
+	// There are no older matches, so the query stays
+	doHistorySearch(input, termbox.Event{})
+	expectQueryString(t, ctx, "bar")
+	doHistoryNext(input, termbox.Event{})
+	expectQueryString(t, ctx, "foo bar")
+
+	// Typing changes what is searched for, from the newest entry
+	input.handleKeyEvent(termbox.Event{Ch: 'r'})
+	expectQueryString(t, ctx, "foo bar")
+	input.handleKeyEvent(termbox.Event{Key: termbox.KeyBackspace2})
+	expectQueryString(t, ctx, "baz")
+
+	// Cancelling puts back what was typed
+	input.handleKeyEvent(termbox.Event{Key: termbox.KeyEsc})
+	expectQueryString(t, ctx, "ba")
+	if h.Searching() {
+		t.Errorf("Expected the search to be cancelled")
+	}
+
+	// Any other action ends the search, keeping the query
+	doHistorySearch(input, termbox.Event{})
+	input.handleKeyEvent(termbox.Event{Key: termbox.KeyCtrlA})
+	if h.Searching() {
+		t.Errorf("Expected the search to end")
+	}
+	input.handleKeyEvent(termbox.Event{Ch: 'x'})
+	expectQueryString(t, ctx, "xbaz")
+}
+
+func TestDoToggleRangeMode(t *testing.T) {
+	ctx := NewCtx(nil)
+	input := ctx.NewInput()
+
+	lines := []Line{}
+	for n := 1; n <= 30; n++ {
+		lines = append(lines, NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+	ctx.SetLines(lines)
+	ctx.SetCurrent(lines)
+
+	// currentLine counts from the first result, not from the top of
+	// the page
+	ctx.currentPage.offset = 10
+	ctx.currentPage.perPage = 10
+	ctx.currentLine = 15
+	doToggleRangeMode(input, termbox.Event{})
+
+	if !ctx.IsRangeMode() {
+		t.Fatalf("Expected range mode to be on")
+	}
+	if selected := ctx.selection.Lines(); len(selected) != 1 || selected[0].Buffer() != "line 15" {
+		t.Errorf("Expected 'line 15' to be selected, got %v", selected)
+	}
+}
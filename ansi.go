@@ -0,0 +1,205 @@
+package peco
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+)
+
+// ansiAttrMask are the attributes that SGR sequences may set besides
+// colors
+const ansiAttrMask = termbox.AttrBold | termbox.AttrUnderline | termbox.AttrReverse
+
+// ansiSpan is a part of a line that was colored by the ANSI sequences
+// in the input (--ansi). start and end are offsets into the line with
+// the sequences stripped, which is what the matches refer to. fg and bg
+// are termbox attributes in the 256 color mode, where 0 leaves the
+// color of the line as it is
+type ansiSpan struct {
+	start int
+	end   int
+	fg    termbox.Attribute
+	bg    termbox.Attribute
+}
+
+// parseANSI strips the ANSI sequences from s, like stripANSISequence,
+// and returns the parts of the result that were colored by SGR
+// sequences. Other sequences are dropped
+func parseANSI(s string) (string, []ansiSpan) {
+	locs := reANSIEscapeChars.FindAllStringIndex(s, -1)
+	if len(locs) == 0 {
+		return s, nil
+	}
+
+	buf := make([]byte, 0, len(s))
+	spans := []ansiSpan{}
+	var fg, bg termbox.Attribute
+	add := func(text string) {
+		if text == "" {
+			return
+		}
+		start := len(buf)
+		buf = append(buf, text...)
+		if fg == 0 && bg == 0 {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].end == start && spans[n-1].fg == fg && spans[n-1].bg == bg {
+			spans[n-1].end = len(buf)
+			return
+		}
+		spans = append(spans, ansiSpan{start, len(buf), fg, bg})
+	}
+
+	prev := 0
+	for _, loc := range locs {
+		add(s[prev:loc[0]])
+		prev = loc[1]
+		if s[loc[1]-1] == 'm' {
+			fg, bg = applySGR(s[loc[0]+2:loc[1]-1], fg, bg)
+		}
+	}
+	add(s[prev:])
+	return string(buf), spans
+}
+
+// applySGR applies the parameters of an SGR sequence (e.g. "1;31") to
+// the current attributes
+func applySGR(params string, fg, bg termbox.Attribute) (termbox.Attribute, termbox.Attribute) {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		// An empty parameter is 0, as in "\x1b[m"
+		n, _ := strconv.Atoi(codes[i])
+		switch {
+		case n == 0:
+			fg, bg = 0, 0
+		case n == 1:
+			fg |= termbox.AttrBold
+		case n == 4:
+			fg |= termbox.AttrUnderline
+		case n == 7:
+			fg |= termbox.AttrReverse
+		case n == 22:
+			fg &^= termbox.AttrBold
+		case n == 24:
+			fg &^= termbox.AttrUnderline
+		case n == 27:
+			fg &^= termbox.AttrReverse
+		case n >= 30 && n <= 37:
+			fg = fg&ansiAttrMask | paletteColor(n-30)
+		case n == 39:
+			fg &= ansiAttrMask
+		case n >= 40 && n <= 47:
+			bg = paletteColor(n - 40)
+		case n == 49:
+			bg = 0
+		case n >= 90 && n <= 97:
+			fg = fg&ansiAttrMask | paletteColor(n-90+8)
+		case n >= 100 && n <= 107:
+			bg = paletteColor(n - 100 + 8)
+		case n == 38, n == 48:
+			c, used := extendedColor(codes[i+1:])
+			i += used
+			if c == 0 {
+				break
+			}
+			if n == 38 {
+				fg = fg&ansiAttrMask | c
+			} else {
+				bg = c
+			}
+		}
+	}
+	return fg, bg
+}
+
+// extendedColor parses the parameters that follow 38 or 48, which are
+// either "5;n" for the 256 color palette, or "2;r;g;b" for true color.
+// It returns the color, or 0 if the parameters are invalid, and the
+// number of parameters that were used
+func extendedColor(codes []string) (termbox.Attribute, int) {
+	if len(codes) == 0 {
+		return 0, 0
+	}
+	num := func(s string, max int) (int, bool) {
+		n, err := strconv.Atoi(s)
+		return n, err == nil && n >= 0 && n <= max
+	}
+
+	switch codes[0] {
+	case "5":
+		if len(codes) < 2 {
+			return 0, len(codes)
+		}
+		n, ok := num(codes[1], 255)
+		if !ok {
+			return 0, 2
+		}
+		return paletteColor(n), 2
+	case "2":
+		if len(codes) < 4 {
+			return 0, len(codes)
+		}
+		r, okR := num(codes[1], 255)
+		g, okG := num(codes[2], 255)
+		b, okB := num(codes[3], 255)
+		if !okR || !okG || !okB {
+			return 0, 4
+		}
+		return paletteColor(rgbToPalette(r, g, b)), 4
+	}
+	return 0, 1
+}
+
+// paletteColor returns the termbox attribute for the n-th color of the
+// 256 color palette
+func paletteColor(n int) termbox.Attribute {
+	return termbox.Attribute(n + 1)
+}
+
+// cubeLevels are the levels of each component in the 6x6x6 color cube
+// of the 256 color palette
+var cubeLevels = []int{0, 95, 135, 175, 215, 255}
+
+// rgbToPalette returns the color of the 256 color palette that is the
+// closest to a true color, among the color cube and the gray ramp
+func rgbToPalette(r, g, b int) int {
+	nearest := func(v int) int {
+		best := 0
+		for i, l := range cubeLevels {
+			if abs(v-l) < abs(v-cubeLevels[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+	distance := func(r1, g1, b1, r2, g2, b2 int) int {
+		return (r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2)
+	}
+
+	ri, gi, bi := nearest(r), nearest(g), nearest(b)
+	cube := 16 + 36*ri + 6*gi + bi
+	cubeDistance := distance(r, g, b, cubeLevels[ri], cubeLevels[gi], cubeLevels[bi])
+
+	// The gray ramp goes from 8 to 238, in steps of 10
+	gray := (r+g+b)/3 - 8
+	if gray < 0 {
+		gray = 0
+	}
+	gi = (gray + 5) / 10
+	if gi > 23 {
+		gi = 23
+	}
+	level := 8 + 10*gi
+	if distance(r, g, b, level, level, level) < cubeDistance {
+		return 232 + gi
+	}
+	return cube
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,83 @@
+package peco
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+)
+
+func TestParseANSI(t *testing.T) {
+	tests := []struct {
+		input    string
+		text     string
+		expected []ansiSpan
+	}{
+		{"plain", "plain", nil},
+		{"\x1b[31mred\x1b[0m plain", "red plain", []ansiSpan{{0, 3, paletteColor(1), 0}}},
+		{"\x1b[1;34mbold blue\x1b[m", "bold blue", []ansiSpan{{0, 9, paletteColor(4) | termbox.AttrBold, 0}}},
+		{"\x1b[92;41mbright\x1b[39m default\x1b[49m", "bright default", []ansiSpan{{0, 6, paletteColor(10), paletteColor(1)}, {6, 14, 0, paletteColor(1)}}},
+		{"\x1b[38;5;208morange\x1b[0m", "orange", []ansiSpan{{0, 6, paletteColor(208), 0}}},
+		{"\x1b[48;2;255;0;0mtrue\x1b[0m", "true", []ansiSpan{{0, 4, 0, paletteColor(196)}}},
+		{"\x1b[38;2;128;128;128mgray\x1b[0m", "gray", []ansiSpan{{0, 4, paletteColor(244), 0}}},
+		// Sequences that don't change the colors merge with the span
+		{"\x1b[33mfoo\x1b[33m\x1b[Kbar", "foobar", []ansiSpan{{0, 6, paletteColor(3), 0}}},
+	}
+
+	for _, test := range tests {
+		text, spans := parseANSI(test.input)
+		if text != test.text {
+			t.Errorf("%q: expected text %q, got %q", test.input, test.text, text)
+		}
+		if text != stripANSISequence(test.input) {
+			t.Errorf("%q: expected text to be the same as stripANSISequence, got %q", test.input, text)
+		}
+		if len(spans) == 0 && len(test.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(spans, test.expected) {
+			t.Errorf("%q: expected spans %v, got %v", test.input, test.expected, spans)
+		}
+	}
+}
+
+func TestDrawLineANSI(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := NewCtx(nil)
+	ctx.SetANSI(true)
+	l := NewListArea(ctx, AnchorTop, 0, true)
+
+	// "foo" is red in the input, and "oba" matched the query
+	line := NewMatchedLine("\x1b[31mfoo\x1b[0mbar", false, [][]int{{2, 5}})
+	l.drawLine(0, line, termbox.ColorDefault, termbox.ColorDefault)
+
+	// Cells may be drawn more than once, the last one is what is seen
+	cells := map[int]interceptorArgs{}
+	for _, args := range i.events["SetCell"] {
+		cells[args[0].(int)] = args
+	}
+
+	expected := []struct {
+		ch rune
+		fg termbox.Attribute
+	}{
+		{'f', paletteColor(1)},
+		{'o', paletteColor(1)},
+		{'o', ctx.config.Style.MatchedFG()},
+		{'b', ctx.config.Style.MatchedFG()},
+		{'a', ctx.config.Style.MatchedFG()},
+		{'r', termbox.ColorDefault},
+	}
+	for x, e := range expected {
+		args, ok := cells[x]
+		if !ok {
+			t.Errorf("Cell %d was not drawn", x)
+			continue
+		}
+		if args[2].(rune) != e.ch || args[3].(termbox.Attribute) != e.fg {
+			t.Errorf("Cell %d: expected %q in %v, got %q in %v", x, e.ch, e.fg, args[2], args[3])
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package peco
+
+// lineBuffer holds the lines that peco searches through. When its size
+// is limited (--buffer-size), once it is full, each new line takes the
+// place of the oldest one, so that memory stays flat however long the
+// input is. Lines are never copied into new Line values, so a line
+// stays the same for as long as it is in the buffer
+type lineBuffer struct {
+	size int // maximum number of lines, 0 if unlimited
+	// lines are the lines in order. Lines are only ever written after
+	// the end of the slice, so that the lines before it may be handed
+	// out without copying them. With a limit, the oldest line is
+	// dropped from the start, and once the end of the array is
+	// reached, the lines are moved to a new array, which has room for
+	// twice as many lines, so that moving them is only needed every
+	// `size` lines
+	lines []Line
+}
+
+func newLineBuffer(size int) *lineBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &lineBuffer{size: size, lines: []Line{}}
+}
+
+// Len returns the number of lines in the buffer
+func (b *lineBuffer) Len() int {
+	return len(b.lines)
+}
+
+// Append adds a line at the end, replacing the oldest line if the
+// buffer is full
+func (b *lineBuffer) Append(l Line) {
+	if b.size > 0 && len(b.lines) >= b.size {
+		b.lines = b.lines[len(b.lines)-b.size+1:]
+		if len(b.lines) == cap(b.lines) {
+			// Don't overwrite lines that someone may still be looking
+			// at, by moving the lines to a new array
+			lines := make([]Line, len(b.lines), 2*b.size)
+			copy(lines, b.lines)
+			b.lines = lines
+		}
+	}
+	b.lines = append(b.lines, l)
+}
+
+// Reset replaces the contents of the buffer with lines, keeping only
+// the last ones if there are too many
+func (b *lineBuffer) Reset(lines []Line) {
+	if b.size > 0 && len(lines) > b.size {
+		lines = lines[len(lines)-b.size:]
+	}
+	// Copy, so that appending doesn't touch the slice of the caller
+	b.lines = make([]Line, len(lines))
+	copy(b.lines, lines)
+}
+
+// Lines returns the lines in the buffer, from the oldest to the
+// newest. The returned slice is never modified by the buffer, so it
+// may be used after the buffer has changed, but it must not be
+// modified by the caller
+func (b *lineBuffer) Lines() []Line {
+	// The length caps the capacity, so that appending to the returned
+	// slice can't write to the array either
+	n := len(b.lines)
+	return b.lines[:n:n]
+}
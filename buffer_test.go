@@ -0,0 +1,82 @@
+package peco
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func bufferContents(lines []Line) []string {
+	got := []string{}
+	for _, l := range lines {
+		got = append(got, l.Buffer())
+	}
+	return got
+}
+
+func TestLineBuffer(t *testing.T) {
+	b := newLineBuffer(3)
+	lines := []Line{}
+	for i := 0; i < 5; i++ {
+		lines = append(lines, NewRawLine(fmt.Sprintf("line %d", i), false))
+	}
+
+	b.Append(lines[0])
+	b.Append(lines[1])
+	before := b.Lines()
+
+	for _, l := range lines[2:] {
+		b.Append(l)
+	}
+	if b.Len() != 3 {
+		t.Errorf("Expected 3 lines, got %d", b.Len())
+	}
+
+	expected := []string{"line 2", "line 3", "line 4"}
+	if got := bufferContents(b.Lines()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	// Lines must be the same values that were appended
+	if b.Lines()[0] != lines[2] {
+		t.Errorf("Expected the lines in the buffer to be the appended lines")
+	}
+
+	// Snapshots are not changed by lines coming in later
+	expected = []string{"line 0", "line 1"}
+	if got := bufferContents(before); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected earlier snapshot to stay %v, got %v", expected, got)
+	}
+
+	// Snapshots of a full buffer are not copies, but are not changed
+	// either, even once the lines are moved to make room
+	full := b.Lines()
+	if again := b.Lines(); &again[0] != &full[0] {
+		t.Errorf("Expected the lines not to be copied")
+	}
+	for i := 5; i < 20; i++ {
+		b.Append(NewRawLine(fmt.Sprintf("line %d", i), false))
+	}
+	expected = []string{"line 2", "line 3", "line 4"}
+	if got := bufferContents(full); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected snapshot of the full buffer to stay %v, got %v", expected, got)
+	}
+	expected = []string{"line 17", "line 18", "line 19"}
+	if got := bufferContents(b.Lines()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	b.Reset(lines)
+	expected = []string{"line 2", "line 3", "line 4"}
+	if got := bufferContents(b.Lines()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v after Reset, got %v", expected, got)
+	}
+
+	unlimited := newLineBuffer(0)
+	for _, l := range lines {
+		unlimited.Append(l)
+	}
+	if unlimited.Len() != len(lines) {
+		t.Errorf("Expected %d lines without a limit, got %d", len(lines), unlimited.Len())
+	}
+}
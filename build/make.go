@@ -39,6 +39,7 @@ func setupDeps() {
 		"github.com/jessevdk/go-flags":  "8ec9564882e7923e632f012761c81c46dcf5bec1",
 		"github.com/mattn/go-runewidth": "63c378b851290989b19ca955468386485f118c65",
 		"github.com/nsf/termbox-go":     "bb19a81afd4bc2729799d1fedb19f7bd7ee284cf",
+		"golang.org/x/text":             "2910a502d2bf",
 	}
 
 	var err error
@@ -108,5 +109,9 @@ func run(name string, args ...string) error {
 }
 
 func repoURL(spec string) string {
+	// golang.org/x/ repositories are not hosted at their import path
+	if strings.HasPrefix(spec, "golang.org/x/") {
+		return "https://go.googlesource.com/" + strings.TrimPrefix(spec, "golang.org/x/")
+	}
 	return "https://" + spec + ".git"
 }
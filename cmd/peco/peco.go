@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/nsf/termbox-go"
@@ -13,19 +16,43 @@ import (
 
 var version = "v0.2.11"
 
+// exitStatusNoInput is used with --exit-0, so that scripts can tell an
+// empty input from peco being cancelled
+const exitStatusNoInput = 2
+
 type cmdOptions struct {
-	OptHelp           bool   `short:"h" long:"help" description:"show this help message and exit"`
-	OptTTY            string `long:"tty" description:"path to the TTY (usually, the value of $TTY)"`
-	OptQuery          string `long:"query" description:"initial value for query"`
-	OptRcfile         string `long:"rcfile" description:"path to the settings file"`
-	OptNoIgnoreCase   bool   `long:"no-ignore-case" description:"start in case-sensitive-mode (DEPRECATED)" default:"false"`
-	OptVersion        bool   `long:"version" description:"print the version and exit"`
-	OptBufferSize     int    `long:"buffer-size" short:"b" description:"number of lines to keep in search buffer"`
-	OptEnableNullSep  bool   `long:"null" description:"expect NUL (\\0) as separator for target/output"`
-	OptInitialIndex   int    `long:"initial-index" description:"position of the initial index of the selection (0 base)"`
-	OptInitialMatcher string `long:"initial-matcher" description:"specify the default matcher"`
-	OptPrompt         string `long:"prompt" description:"specify the prompt string"`
-	OptLayout         string `long:"layout" description:"layout to be used 'top-down' (default) or 'bottom-up'" default:"top-down"`
+	OptHelp           bool     `short:"h" long:"help" description:"show this help message and exit"`
+	OptTTY            string   `long:"tty" description:"path to the TTY (usually, the value of $TTY)"`
+	OptQuery          string   `long:"query" description:"initial value for query"`
+	OptRcfile         string   `long:"rcfile" description:"path to the settings file"`
+	OptNoIgnoreCase   bool     `long:"no-ignore-case" description:"start in case-sensitive-mode (DEPRECATED)" default:"false"`
+	OptVersion        bool     `long:"version" description:"print the version and exit"`
+	OptBufferSize     int      `long:"buffer-size" short:"b" description:"number of lines to keep in search buffer"`
+	OptEnableNullSep  bool     `long:"null" description:"expect NUL (\\0) as separator for target/output"`
+	OptInitialIndex   int      `long:"initial-index" description:"position of the initial index of the selection (0 base)"`
+	OptInitialMatcher string   `long:"initial-matcher" description:"specify the default matcher"`
+	OptPrompt         string   `long:"prompt" description:"specify the prompt string"`
+	OptLayout         string   `long:"layout" description:"layout to be used 'top-down' (default) or 'bottom-up'" default:"top-down"`
+	OptDelimiter      string   `long:"delimiter" description:"delimiter used to split lines into fields for --match-fields (default: whitespace)"`
+	OptMatchFields    string   `long:"match-fields" description:"only match against these fields (e.g. '2..', '1,3')"`
+	OptHistoryKey     string   `long:"history-key" description:"keep a separate query history under this name"`
+	OptContext        int      `long:"context" description:"show this many lines of input before and after each match"`
+	OptSelect1        bool     `long:"select-1" description:"if there is only one line (after --query), print it and exit without the user interface"`
+	OptExit0          bool     `long:"exit-0" description:"exit with status 2 without the user interface if the input is empty"`
+	OptSourceCommand  string   `long:"source-command" description:"read the input from this command, which is run again by peco.Reload"`
+	OptReloadInterval int      `long:"reload-interval" description:"with --source-command, reload the input every this many seconds"`
+	OptWithFilename   bool     `long:"with-filename" description:"display and output the name of the file before each line"`
+	OptFollow         bool     `long:"follow" description:"keep reading the files as they grow, like tail -F"`
+	OptRead0          bool     `long:"read0" description:"read input records separated by NUL (\\0) instead of newlines"`
+	OptInputDelimiter string   `long:"input-delimiter" description:"read input records separated by this string instead of newlines"`
+	OptInputEncoding  string   `long:"input-encoding" description:"convert the input from this encoding (e.g. 'shift_jis', 'utf-16', or 'auto' to guess it)"`
+	OptOutputUTF8     bool     `long:"output-utf8" description:"output the selected lines in UTF-8, instead of the encoding of the input"`
+	OptWalk           bool     `long:"walk" description:"list the files under the directories given as arguments (default: the current directory), respecting .gitignore"`
+	OptWalkInclude    []string `long:"walk-include" description:"with --walk, only list the files that match this glob (may be repeated)"`
+	OptWalkExclude    []string `long:"walk-exclude" description:"with --walk, skip the files and directories that match this glob (may be repeated)"`
+	OptWalkHidden     bool     `long:"walk-hidden" description:"with --walk, also list hidden files and directories"`
+	OptANSI           bool     `long:"ansi" description:"display the colors of ANSI escape sequences in the input, instead of stripping them"`
+	OptPrintIndex     bool     `long:"print-index" description:"output the position (0 base) of each line in its input before it"`
 }
 
 func showHelp() {
@@ -33,7 +60,7 @@ func showHelp() {
 	// because I wanted to tweak the format just a bit... but
 	// there wasn't an easy way to do so
 	os.Stderr.WriteString(`
-Usage: peco [options] [FILE]
+Usage: peco [options] [FILE...]
 
 Options:
 `)
@@ -116,19 +143,102 @@ func main() {
 		return
 	}
 
-	var in *os.File
+	if opts.OptFollow && opts.OptSelect1 {
+		// --select-1 waits for the end of the input, which never comes
+		fmt.Fprintln(os.Stderr, "--select-1 can't be used with --follow")
+		st = 1
+		return
+	}
 
-	// receive in from either a file or Stdin
+	if opts.OptWalk && (opts.OptSourceCommand != "" || opts.OptFollow) {
+		fmt.Fprintln(os.Stderr, "--walk can't be used with --source-command or --follow")
+		st = 1
+		return
+	}
+
+	// Records are written out with the delimiter that separated them
+	// in the input, so that they can be read back the same way
+	delimiter := ""
 	switch {
-	case len(args) > 0:
-		in, err = os.Open(args[0])
+	case opts.OptRead0 && opts.OptInputDelimiter != "":
+		fmt.Fprintln(os.Stderr, "--read0 can't be used with --input-delimiter")
+		st = 1
+		return
+	case opts.OptRead0 && opts.OptEnableNullSep:
+		fmt.Fprintln(os.Stderr, "--read0 can't be used with --null")
+		st = 1
+		return
+	case opts.OptRead0:
+		delimiter = "\x00"
+	case opts.OptInputDelimiter != "":
+		delimiter, err = strconv.Unquote(`"` + opts.OptInputDelimiter + `"`)
+		if err != nil || delimiter == "" {
+			fmt.Fprintf(os.Stderr, "Invalid input delimiter: '%s'\n", opts.OptInputDelimiter)
+			st = 1
+			return
+		}
+	}
+
+	// The inputs, and their names (see peco.Line.Source)
+	var inputs []io.ReadCloser
+	var names []string
+	var source *peco.SourceCommand
+
+	// receive in from either the source command, the walker, files or Stdin
+	switch {
+	case opts.OptSourceCommand != "":
+		source = peco.NewSourceCommand(opts.OptSourceCommand)
+		in, err := source.Start()
 		if err != nil {
 			st = 1
 			fmt.Fprintln(os.Stderr, err)
 			return
 		}
+		inputs = append(inputs, in)
+		names = append(names, "")
+	case opts.OptWalk:
+		// The arguments are the directories to walk
+		walker := peco.NewWalker(args)
+		walker.SetHidden(opts.OptWalkHidden)
+		if err = walker.SetInclude(opts.OptWalkInclude); err == nil {
+			err = walker.SetExclude(opts.OptWalkExclude)
+		}
+		var in io.ReadCloser
+		if err == nil {
+			in, err = walker.Start(delimiter)
+		}
+		if err != nil {
+			st = 1
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		inputs = append(inputs, in)
+		names = append(names, "")
+	case len(args) > 0:
+		// All of the files are read concurrently. "-" is Stdin
+		for _, name := range args {
+			if name == "-" {
+				inputs = append(inputs, os.Stdin)
+				names = append(names, name)
+				continue
+			}
+			var in io.ReadCloser
+			if opts.OptFollow {
+				in, err = peco.NewFollowReader(name)
+			} else {
+				in, err = os.Open(name)
+			}
+			if err != nil {
+				st = 1
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			inputs = append(inputs, in)
+			names = append(names, name)
+		}
 	case !peco.IsTty(os.Stdin.Fd()):
-		in = os.Stdin
+		inputs = append(inputs, os.Stdin)
+		names = append(names, "-")
 	default:
 		fmt.Fprintln(os.Stderr, "You must supply something to work with via filename or stdin")
 		st = 1
@@ -136,6 +246,14 @@ func main() {
 	}
 
 	ctx := peco.NewCtx(opts)
+	if source != nil {
+		ctx.SetSourceCommand(source)
+	}
+	ctx.SetWithFilename(opts.OptWithFilename)
+	ctx.SetInputDelimiter(delimiter)
+	ctx.SetOutputUTF8(opts.OptOutputUTF8)
+	ctx.SetANSI(opts.OptANSI)
+	ctx.SetPrintIndex(opts.OptPrintIndex)
 	defer func() {
 		if err := recover(); err != nil {
 			st = 1
@@ -148,11 +266,7 @@ func main() {
 		}
 
 		for match := range ch {
-			line := match.Output()
-			if line[len(line)-1] != '\n' {
-				line = line + "\n"
-			}
-			fmt.Fprint(os.Stdout, line)
+			fmt.Fprint(os.Stdout, ctx.OutputRecord(match))
 		}
 	}()
 
@@ -179,6 +293,28 @@ func main() {
 		ctx.SetPrompt(opts.OptPrompt)
 	}
 
+	if opts.OptContext > 0 {
+		ctx.SetContextLines(opts.OptContext)
+	}
+
+	if err = ctx.SetInputEncoding(opts.OptInputEncoding); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		st = 1
+		return
+	}
+
+	if err = ctx.SetMatchFields(opts.OptDelimiter, opts.OptMatchFields); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		st = 1
+		return
+	}
+
+	if err = ctx.LoadHistory(opts.OptHistoryKey); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		st = 1
+		return
+	}
+
 	// Deprecated. --no-ignore-case options will be removed in later.
 	if opts.OptNoIgnoreCase {
 		ctx.MatcherSet.SetCurrentByName(peco.CaseSensitiveMatch)
@@ -194,12 +330,45 @@ func main() {
 
 	// Try waiting for something available in the source stream
 	// before doing any terminal initialization (also done by termbox)
-	reader := ctx.NewBufferReader(in)
-	ctx.AddWaitGroup(1)
-	go reader.Loop()
+	readers := make([]*peco.BufferReader, len(inputs))
+	for i, in := range inputs {
+		readers[i] = ctx.NewBufferReader(in)
+		readers[i].SetSource(names[i])
+		ctx.AddWaitGroup(1)
+		go readers[i].Loop()
+	}
 
-	// This channel blocks until we receive something from `in`
-	<-reader.InputReadyCh()
+	// This blocks until we receive something from any of the inputs
+	if !peco.WaitInputReady(readers) {
+		// The inputs ended before we received anything
+		if opts.OptExit0 {
+			st = exitStatusNoInput
+			return
+		}
+		fmt.Fprintln(os.Stderr, "No buffer to work with was available")
+		st = 1
+		return
+	}
+
+	if opts.OptSelect1 {
+		// Wait for the whole input, as we can't tell whether there
+		// is only one line otherwise
+		peco.WaitInputDone(readers)
+
+		lines := ctx.GetLines()
+		if len(opts.OptQuery) > 0 {
+			lines, err = ctx.MatchLines(opts.OptQuery, lines)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				st = 1
+				return
+			}
+		}
+		if len(lines) == 1 {
+			ctx.SetResult(lines)
+			return
+		}
+	}
 
 	err = peco.TtyReady()
 	if err != nil {
@@ -222,6 +391,11 @@ func main() {
 		termbox.SetInputMode(termbox.InputEsc | termbox.InputAlt)
 	}
 
+	// The colors of the input may be any of the 256 color palette
+	if opts.OptANSI {
+		termbox.SetOutputMode(termbox.Output256)
+	}
+
 	view := ctx.NewView()
 	filter := ctx.NewFilter()
 	input := ctx.NewInput()
@@ -235,6 +409,10 @@ func main() {
 		input,
 		sig,
 	}
+	if source != nil && opts.OptReloadInterval > 0 {
+		interval := time.Duration(opts.OptReloadInterval) * time.Second
+		loopers = append(loopers, ctx.NewReloader(interval))
+	}
 	for _, looper := range loopers {
 		ctx.AddWaitGroup(1)
 		go looper.Loop()
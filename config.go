@@ -25,7 +25,24 @@ type Config struct {
 	Style          *StyleSet         `json:"Style"`
 	Prompt         string            `json:"Prompt"`
 	Layout         string            `json:"Layout"`
+	Ranking        bool              `json:"Ranking"` // Sort results by match quality
+	Delimiter      string            `json:"Delimiter"`
+	MatchFields    string            `json:"MatchFields"`
+	ContextLines   int               `json:"ContextLines"` // Lines to show around each match
 	CustomMatcher  map[string][]string
+	// CustomMatcherOptions changes how the matchers in CustomMatcher
+	// are run, by the name of the matcher
+	CustomMatcherOptions map[string]CustomMatcherOptions `json:"CustomMatcherOptions"`
+}
+
+// CustomMatcherOptions describes how a custom matcher is run
+type CustomMatcherOptions struct {
+	// Server starts the program once and keeps it running, instead
+	// of running it for every query. See customMatcherServer
+	Server bool `json:"Server"`
+	// Format is the format that the results are printed in, either
+	// "lines" (default) or "json". Only used when Server is false
+	Format string `json:"Format"`
 }
 
 // NewConfig creates a new Config
@@ -100,6 +117,7 @@ type StyleSet struct {
 	Selected       Style `json:"Selected"`
 	Query          Style `json:"Query"`
 	Matched        Style `json:"Matched"`
+	Context        Style `json:"Context"`
 }
 
 // NewStyleSet creates a new StyleSet struct
@@ -110,6 +128,8 @@ func NewStyleSet() *StyleSet {
 		Matched:        Style{fg: termbox.ColorCyan, bg: termbox.ColorDefault},
 		SavedSelection: Style{fg: termbox.ColorBlack | termbox.AttrBold, bg: termbox.ColorCyan},
 		Selected:       Style{fg: termbox.ColorDefault | termbox.AttrUnderline, bg: termbox.ColorMagenta},
+		// Bold black is displayed as gray by most terminals
+		Context: Style{fg: termbox.ColorBlack | termbox.AttrBold, bg: termbox.ColorDefault},
 	}
 }
 
@@ -153,6 +173,14 @@ func (s StyleSet) SelectedBG() termbox.Attribute {
 	return s.Selected.bg
 }
 
+func (s StyleSet) ContextFG() termbox.Attribute {
+	return s.Context.fg
+}
+
+func (s StyleSet) ContextBG() termbox.Attribute {
+	return s.Context.bg
+}
+
 // Style describes termbox styles
 type Style struct {
 	fg termbox.Attribute
@@ -213,6 +241,20 @@ func locateRcfileIn(dir string) (string, error) {
 
 // LocateRcfile attempts to find the config file in various locations
 func LocateRcfile() (string, error) {
+	for _, dir := range configDirs(true) {
+		file, err := _locateRcfileIn(dir)
+		if err == nil {
+			return file, nil
+		}
+	}
+
+	return "", fmt.Errorf("error: Config file not found")
+}
+
+// configDirs returns the directories that may contain peco's files, in
+// the order that they should be searched. The system wide directories
+// listed in $XDG_CONFIG_DIRS are only included if `system` is true
+func configDirs(system bool) []string {
 	// http://standards.freedesktop.org/basedir-spec/basedir-spec-latest.html
 	//
 	// Try in this order:
@@ -220,40 +262,29 @@ func LocateRcfile() (string, error) {
 	//    $XDG_CONFIG_DIR/peco/config.json (where XDG_CONFIG_DIR is listed in $XDG_CONFIG_DIRS)
 	//	  ~/.peco/config.json
 
+	dirs := []string{}
 	home, uErr := homedirFunc()
 
 	// Try dir supplied via env var
 	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
-		file, err := _locateRcfileIn(filepath.Join(dir, "peco"))
-		if err == nil {
-			return file, nil
-		}
+		dirs = append(dirs, filepath.Join(dir, "peco"))
 	} else if uErr == nil { // silently ignore failure for homedir()
 		// Try "default" XDG location, is user is available
-		file, err := _locateRcfileIn(filepath.Join(home, ".config", "peco"))
-		if err == nil {
-			return file, nil
-		}
+		dirs = append(dirs, filepath.Join(home, ".config", "peco"))
 	}
 
 	// this standard does not take into consideration windows (duh)
 	// while the spec says use ":" as the separator, Go provides us
 	// with filepath.ListSeparator, so use it
-	if dirs := os.Getenv("XDG_CONFIG_DIRS"); dirs != "" {
-		for _, dir := range strings.Split(dirs, fmt.Sprintf("%c", filepath.ListSeparator)) {
-			file, err := _locateRcfileIn(filepath.Join(dir, "peco"))
-			if err == nil {
-				return file, nil
-			}
+	if list := os.Getenv("XDG_CONFIG_DIRS"); system && list != "" {
+		for _, dir := range strings.Split(list, fmt.Sprintf("%c", filepath.ListSeparator)) {
+			dirs = append(dirs, filepath.Join(dir, "peco"))
 		}
 	}
 
 	if uErr == nil { // silently ignore failure for homedir()
-		file, err := _locateRcfileIn(filepath.Join(home, ".peco"))
-		if err == nil {
-			return file, nil
-		}
+		dirs = append(dirs, filepath.Join(home, ".peco"))
 	}
 
-	return "", fmt.Errorf("error: Config file not found")
+	return dirs
 }
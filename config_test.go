@@ -35,6 +35,48 @@ func TestReadRC(t *testing.T) {
 	t.Logf("%#q", cfg)
 }
 
+func TestReadCustomMatcherOptions(t *testing.T) {
+	txt := `
+{
+	"CustomMatcher": {
+		"Plain": ["true"],
+		"Server": ["true"]
+	},
+	"CustomMatcherOptions": {
+		"Server": { "Server": true, "Format": "json" }
+	}
+}
+`
+	ctx := NewCtx(nil)
+	if err := json.Unmarshal([]byte(txt), ctx.config); err != nil {
+		t.Fatalf("Error unmarshaling json: %s", err)
+	}
+	if args := ctx.config.CustomMatcher["Plain"]; len(args) != 1 || args[0] != "true" {
+		t.Errorf("Expected the arguments of the matcher, got %v", args)
+	}
+	if err := ctx.LoadCustomMatcher(); err != nil {
+		t.Fatalf("LoadCustomMatcher failed: %s", err)
+	}
+
+	for _, name := range []string{"Plain", "Server"} {
+		if !ctx.MatcherSet.SetCurrentByName(name) {
+			t.Fatalf("Expected the custom matcher '%s' to be loaded", name)
+		}
+		m := ctx.Matcher().(*CustomMatcher)
+		if server := m.server != nil; server != (name == "Server") {
+			t.Errorf("Matcher '%s': expected server mode to be %t", name, !server)
+		}
+	}
+	if m := ctx.Matcher().(*CustomMatcher); m.format != CustomMatcherFormatJSON {
+		t.Errorf("Expected format '%s', got '%s'", CustomMatcherFormatJSON, m.format)
+	}
+
+	ctx.config.CustomMatcherOptions["Unknown"] = CustomMatcherOptions{Server: true}
+	if err := ctx.LoadCustomMatcher(); err == nil {
+		t.Errorf("Expected an error for the options of an unknown matcher")
+	}
+}
+
 type stringsToStyleTest struct {
 	strings []string
 	style   *Style
@@ -0,0 +1,279 @@
+package peco
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// customMatcherServer runs a CustomMatcher in "server" mode. Instead
+// of spawning a new process for every query, the process is started
+// once and kept around. peco and the process talk to each other using
+// line delimited JSON:
+//
+// peco sends the lines in the buffer once. Each line is identified by
+// its position in the buffer, and comes with its ID (see Line.ID) and
+// its position in the input (see Line.Index). If the buffer changes
+// other than lines being appended to it, a "reset" is sent and the
+// lines are sent again. Lines that were sent before keep their line_id:
+//
+//	{"type":"reset"}
+//	{"type":"line","id":0,"line":"...","line_id":1,"index":0}
+//
+// Then for each query, peco sends a request, and the process must reply
+// with the same id and the ids of the lines that matched. Instead of
+// "lines", the reply may contain "matches" with the byte ranges to
+// highlight in each line, which may refer to the line by its line_id:
+//
+//	{"type":"query","id":1,"query":"foo"}
+//	{"id":1,"lines":[0,3,5]}
+//	{"id":1,"matches":[{"line":0,"indices":[[0,3]]},{"line_id":6}]}
+//
+// Only the latest query is waited on. Responses to queries that have
+// been superseded by a newer query are silently dropped
+//
+// The process may write responses while peco is still sending it lines,
+// so the responses are read without taking the mutex that is held while
+// writing, or both sides could wait on each other forever
+type customMatcherServer struct {
+	args   []string
+	mutex  sync.Locker // held while starting the process and writing to it
+	cmd    *exec.Cmd
+	done   chan struct{} // closed once the process has exited
+	stdin  *json.Encoder
+	closer io.Closer
+	sent   []Line
+	nextID int
+
+	pendingMutex sync.Locker
+	pending      map[int]chan customMatcherResponse
+}
+
+var errProcessExited = errors.New("process exited before responding")
+
+type customMatcherMessage struct {
+	Type  string `json:"type"`
+	ID    int    `json:"id"`
+	Line  string `json:"line,omitempty"`
+	Query string `json:"query,omitempty"`
+}
+
+// customMatcherLine is a "line" message. Index is -1 if the position
+// of the line in its input is not known
+type customMatcherLine struct {
+	Type   string `json:"type"`
+	ID     int    `json:"id"`
+	Line   string `json:"line"`
+	LineID uint64 `json:"line_id"`
+	Index  int    `json:"index"`
+}
+
+type customMatcherResponse struct {
+	ID      int                  `json:"id"`
+	Lines   []int                `json:"lines"`
+	Matches []customMatcherMatch `json:"matches"`
+}
+
+func newCustomMatcherServer(args []string) *customMatcherServer {
+	return &customMatcherServer{
+		args:         args,
+		mutex:        newMutex(),
+		pendingMutex: newMutex(),
+		pending:      map[int]chan customMatcherResponse{},
+	}
+}
+
+// start spawns the process. Must be called with the mutex held
+func (s *customMatcherServer) start() error {
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	s.cmd = cmd
+	s.done = make(chan struct{})
+	s.stdin = json.NewEncoder(stdin)
+	s.closer = stdin
+	s.sent = nil
+	go s.readResponses(cmd, stdout, s.done)
+	return nil
+}
+
+// readResponses dispatches the responses from the process to the
+// queries waiting for them, until the process exits. It must never wait
+// for s.mutex, which is held while writing to the process
+func (s *customMatcherServer) readResponses(cmd *exec.Cmd, stdout io.Reader, done chan struct{}) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		res := customMatcherResponse{}
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			continue
+		}
+
+		s.pendingMutex.Lock()
+		ch, ok := s.pending[res.ID]
+		delete(s.pending, res.ID)
+		s.pendingMutex.Unlock()
+
+		if ok {
+			ch <- res
+		}
+	}
+	cmd.Wait()
+
+	// The process is gone. Tell whoever is waiting, and make sure
+	// that the next query starts a new process
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	close(done)
+	for id, ch := range s.pending {
+		close(ch)
+		delete(s.pending, id)
+	}
+}
+
+// exited returns true if the process has exited. Must be called with
+// the mutex held
+func (s *customMatcherServer) exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendBuffer makes sure that the process has the same lines as
+// `buffer`. Must be called with the mutex held
+func (s *customMatcherServer) sendBuffer(buffer []Line) error {
+	appended := len(buffer) >= len(s.sent)
+	for i := 0; appended && i < len(s.sent); i++ {
+		appended = buffer[i] == s.sent[i]
+	}
+
+	start := len(s.sent)
+	if !appended {
+		if err := s.stdin.Encode(customMatcherMessage{Type: "reset"}); err != nil {
+			return err
+		}
+		start = 0
+	}
+
+	for i := start; i < len(buffer); i++ {
+		msg := customMatcherLine{
+			Type:   "line",
+			ID:     i,
+			Line:   buffer[i].DisplayString(),
+			LineID: buffer[i].ID(),
+			Index:  buffer[i].Index(),
+		}
+		if err := s.stdin.Encode(msg); err != nil {
+			return err
+		}
+	}
+
+	s.sent = make([]Line, len(buffer))
+	copy(s.sent, buffer)
+	return nil
+}
+
+// query sends the query to the process, and returns the channel that
+// the response will be sent to, along with the lines that the ids in
+// the response refer to
+func (s *customMatcherServer) query(q string, buffer []Line) (int, chan customMatcherResponse, []Line, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cmd == nil || s.exited() {
+		if err := s.start(); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	if err := s.sendBuffer(buffer); err != nil {
+		s.kill()
+		return 0, nil, nil, err
+	}
+
+	s.nextID++
+	id := s.nextID
+	ch := make(chan customMatcherResponse, 1)
+
+	s.pendingMutex.Lock()
+	if s.exited() {
+		s.pendingMutex.Unlock()
+		return 0, nil, nil, errProcessExited
+	}
+	// Any queries still waiting have been superseded by this one
+	for id := range s.pending {
+		delete(s.pending, id)
+	}
+	s.pending[id] = ch
+	s.pendingMutex.Unlock()
+
+	if err := s.stdin.Encode(customMatcherMessage{Type: "query", ID: id, Query: q}); err != nil {
+		s.kill()
+		return 0, nil, nil, err
+	}
+	return id, ch, s.sent, nil
+}
+
+func (s *customMatcherServer) cancel(id int) {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	delete(s.pending, id)
+}
+
+// kill stops the process. Must be called with the mutex held
+func (s *customMatcherServer) kill() {
+	if s.cmd == nil {
+		return
+	}
+	s.closer.Close()
+	if p := s.cmd.Process; p != nil {
+		p.Kill()
+	}
+}
+
+// Line sends the query to the process, and waits for the response.
+// If anything is received via `quit` in the mean time, the query is
+// abandoned and its response will be dropped
+func (s *customMatcherServer) Line(m *CustomMatcher, quit chan struct{}, q string, buffer []Line) ([]Line, error) {
+	results := []Line{}
+	id, ch, lines, err := s.query(q, buffer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", m.name, err)
+	}
+
+	select {
+	case <-quit:
+		s.cancel(id)
+	case res, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", m.name, errProcessExited)
+		}
+		for _, i := range res.Lines {
+			res.Matches = append(res.Matches, customMatcherMatch{Line: i})
+		}
+		index := newLineIndex(lines)
+		for _, match := range res.Matches {
+			if l := m.matchedLine(index, match); l != nil {
+				results = append(results, l)
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,165 @@
+package peco
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCustomMatcherServerHelper isn't a real test. It's the process
+// that is run by TestCustomMatcherServer, which matches lines using
+// strings.Contains. Every other reply refers to the lines by their
+// IDs instead of their positions. With PECO_TEST_SERVER_CHATTY set, it
+// also replies to each line, with an id that no query has
+func TestCustomMatcherServerHelper(t *testing.T) {
+	if os.Getenv("PECO_TEST_SERVER_HELPER") != "1" {
+		return
+	}
+	defer os.Exit(0)
+	chatty := os.Getenv("PECO_TEST_SERVER_CHATTY") == "1"
+
+	lines := []customMatcherLine{}
+	enc := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		msg := customMatcherMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			os.Exit(1)
+		}
+
+		switch msg.Type {
+		case "reset":
+			lines = []customMatcherLine{}
+		case "line":
+			l := customMatcherLine{}
+			if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+				os.Exit(1)
+			}
+			lines = append(lines, l)
+			if chatty {
+				enc.Encode(customMatcherResponse{ID: -1})
+			}
+		case "query":
+			res := customMatcherResponse{ID: msg.ID, Lines: []int{}}
+			for i, l := range lines {
+				switch {
+				case !strings.Contains(l.Line, msg.Query):
+				case msg.ID%2 == 0:
+					res.Matches = append(res.Matches, customMatcherMatch{LineID: l.LineID})
+				default:
+					res.Lines = append(res.Lines, i)
+				}
+			}
+			enc.Encode(res)
+		}
+	}
+}
+
+func TestCustomMatcherServer(t *testing.T) {
+	os.Setenv("PECO_TEST_SERVER_HELPER", "1")
+	defer os.Setenv("PECO_TEST_SERVER_HELPER", "")
+
+	m := NewCustomMatcher(false, "Server", []string{os.Args[0], "-test.run=TestCustomMatcherServerHelper"})
+	m.EnableServer()
+
+	buffer := []Line{
+		NewRawLine("foo", false),
+		NewRawLine("bar", false),
+		NewRawLine("foobar", false),
+	}
+
+	check := func(q string, buffer []Line, expected ...string) {
+		results := m.Line(make(chan struct{}), q, buffer)
+		if len(results) != len(expected) {
+			t.Errorf("Query '%s': expected %d results, got %d", q, len(expected), len(results))
+			return
+		}
+		for i, l := range results {
+			if l.Buffer() != expected[i] {
+				t.Errorf("Query '%s': expected '%s', got '%s'", q, expected[i], l.Buffer())
+			}
+		}
+	}
+
+	check("foo", buffer, "foo", "foobar")
+	pid := m.server.cmd.Process.Pid
+
+	// The IDs of the lines are used to find them
+	check("bar", buffer, "bar", "foobar")
+
+	// Lines that are appended are sent, and the process is reused
+	buffer = append(buffer, NewRawLine("barbaz", false))
+	check("bar", buffer, "bar", "foobar", "barbaz")
+
+	// A completely different buffer is sent all over again
+	check("baz", []Line{NewRawLine("baz", false)}, "baz")
+
+	if p := m.server.cmd.Process.Pid; p != pid {
+		t.Errorf("Expected the process to be reused (pid %d), got pid %d", pid, p)
+	}
+
+	m.server.mutex.Lock()
+	m.server.kill()
+	m.server.mutex.Unlock()
+}
+
+func TestCustomMatcherServerLargeBuffer(t *testing.T) {
+	os.Setenv("PECO_TEST_SERVER_HELPER", "1")
+	os.Setenv("PECO_TEST_SERVER_CHATTY", "1")
+	defer os.Setenv("PECO_TEST_SERVER_HELPER", "")
+	defer os.Setenv("PECO_TEST_SERVER_CHATTY", "")
+
+	m := NewCustomMatcher(false, "Server", []string{os.Args[0], "-test.run=TestCustomMatcherServerHelper"})
+	m.EnableServer()
+
+	// The process writes more than a pipe can hold while the lines are
+	// still being sent, so the responses must be read in the mean time
+	buffer := []Line{}
+	for i := 0; i < 20000; i++ {
+		buffer = append(buffer, NewRawLine(fmt.Sprintf("line %d", i), false))
+	}
+
+	done := make(chan []Line)
+	go func() {
+		done <- m.Line(make(chan struct{}), "line 12345", buffer)
+	}()
+	select {
+	case results := <-done:
+		if len(results) != 1 {
+			t.Errorf("Expected 1 result, got %d", len(results))
+		}
+	case <-time.After(10 * time.Second):
+		// The query still holds the mutex, so the process can't be
+		// stopped here
+		t.Fatalf("Timed out waiting for the results")
+	}
+
+	m.server.mutex.Lock()
+	m.server.kill()
+	m.server.mutex.Unlock()
+}
+
+func TestCustomMatcherServerLineMessages(t *testing.T) {
+	first := NewRawLine("first", false)
+	first.index = 2
+	second := NewRawLine("second", false)
+
+	s := newCustomMatcherServer(nil)
+	out := &bytes.Buffer{}
+	s.stdin = json.NewEncoder(out)
+	if err := s.sendBuffer([]Line{first, second}); err != nil {
+		t.Fatalf("sendBuffer failed: %s", err)
+	}
+
+	expected := fmt.Sprintf(`{"type":"line","id":0,"line":"first","line_id":%d,"index":2}
+{"type":"line","id":1,"line":"second","line_id":%d,"index":-1}
+`, first.ID(), second.ID())
+	if out.String() != expected {
+		t.Errorf("Expected messages %q, got %q", expected, out.String())
+	}
+}
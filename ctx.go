@@ -6,8 +6,12 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+
+	"golang.org/x/text/encoding"
 )
 
 const debug = false
@@ -120,7 +124,9 @@ type Ctx struct {
 	currentLine         int
 	currentPage         *PageInfo
 	selection           *Selection
-	lines               []Line
+	lines               *lineBuffer
+	linesGeneration     uint64
+	linesReplaced       uint64
 	linesMutex          sync.Locker
 	current             []Line
 	currentMutex        sync.Locker
@@ -129,6 +135,20 @@ type Ctx struct {
 	exitStatus          int
 	selectionRangeStart int
 	layoutType          string
+	enableRanking       bool
+	fieldSelector       *FieldSelector
+	history             *History
+	contextLines        int
+	showContext         bool
+	linePositions       map[Line]int
+	source              *SourceCommand
+	withFilename        bool
+	inputDelimiter      string
+	inputEncoding       string
+	outputUTF8          bool
+	encodings           map[string]encoding.Encoding
+	ansi                bool
+	printIndex          bool
 
 	wait *sync.WaitGroup
 }
@@ -168,7 +188,6 @@ func NewCtx(o CtxOptions) *Ctx {
 		mutex:               newMutex(),
 		currentPage:         &PageInfo{0, 1, 0, 0, 0},
 		selection:           NewSelection(),
-		lines:               []Line{},
 		linesMutex:          newMutex(),
 		current:             nil,
 		currentMutex:        newMutex(),
@@ -177,6 +196,7 @@ func NewCtx(o CtxOptions) *Ctx {
 		selectionRangeStart: invalidSelectionRange,
 		wait:                &sync.WaitGroup{},
 		layoutType:          "top-down",
+		encodings:           map[string]encoding.Encoding{},
 	}
 
 	if o != nil {
@@ -190,11 +210,16 @@ func NewCtx(o CtxOptions) *Ctx {
 		}
 	}
 
+	c.lines = newLineBuffer(c.bufferSize)
+
 	matchers := []Matcher{
 		NewIgnoreCaseMatcher(c.enableSep),
 		NewCaseSensitiveMatcher(c.enableSep),
 		NewSmartCaseMatcher(c.enableSep),
 		NewRegexpMatcher(c.enableSep),
+		NewFuzzyMatcher(c.enableSep),
+		NewNormalizedMatcher(c.enableSep),
+		NewExtendedMatcher(c.enableSep),
 	}
 	matcherSet := NewMatcherSet()
 	for _, m := range matchers {
@@ -229,33 +254,169 @@ func (c *Ctx) ReadConfig(file string) error {
 		}
 	}
 
+	c.SetRankingEnabled(c.config.Ranking)
+	c.SetContextLines(c.config.ContextLines)
+
+	if err := c.SetMatchFields("", ""); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// SetMatchFields restricts matching to the given fields of each line,
+// split by `delimiter` (--match-fields, --delimiter). Empty values keep
+// the current settings, which may have come from the config file
+func (c *Ctx) SetMatchFields(delimiter, fields string) error {
+	if delimiter != "" {
+		c.config.Delimiter = delimiter
+	}
+	if fields != "" {
+		c.config.MatchFields = fields
+	}
+
+	if c.config.MatchFields == "" {
+		c.fieldSelector = nil
+		return nil
+	}
+
+	s, err := NewFieldSelector(c.config.Delimiter, c.config.MatchFields, c.enableSep)
+	if err != nil {
+		return fmt.Errorf("invalid match fields '%s': %s", c.config.MatchFields, err)
+	}
+	c.fieldSelector = s
+	return nil
+}
+
+// LoadHistory loads the queries of previous sessions with the given
+// key (--history-key) from the history file. History stays disabled
+// if there is nowhere to keep the file, e.g. when $HOME is not set
+func (c *Ctx) LoadHistory(key string) error {
+	file, err := LocateHistoryFile()
+	if err != nil {
+		return nil
+	}
+
+	h := NewHistory(file, key)
+	if err := h.Load(); err != nil {
+		return err
+	}
+	c.history = h
+	return nil
+}
+
+// IsRankingEnabled returns true if the results of a query should be
+// sorted by how well each line matched, instead of the input order
+func (c *Ctx) IsRankingEnabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.enableRanking
+}
+
+func (c *Ctx) SetRankingEnabled(b bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.enableRanking = b
+}
+
+// defaultContextLines is used by peco.ToggleContext when the number of
+// context lines hasn't been specified
+const defaultContextLines = 3
+
+// ContextLines returns the number of lines that should be displayed
+// before and after each match, or 0 if context is not shown
+func (c *Ctx) ContextLines() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.showContext {
+		return 0
+	}
+	return c.contextLines
+}
+
+// SetContextLines sets the number of context lines (--context), and
+// starts showing them. 0 hides them
+func (c *Ctx) SetContextLines(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if n <= 0 {
+		c.showContext = false
+		return
+	}
+	c.contextLines = n
+	c.showContext = true
+}
+
+// ToggleContext shows or hides the context lines, and returns the
+// number of lines that are now displayed
+func (c *Ctx) ToggleContext() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.showContext = !c.showContext
+	if !c.showContext {
+		return 0
+	}
+	if c.contextLines <= 0 {
+		c.contextLines = defaultContextLines
+	}
+	return c.contextLines
+}
+
+// SetLines replaces the lines in the buffer. Only the last lines are
+// kept if there are more than --buffer-size. BufferReaders that were
+// created before stop adding lines to the buffer
 func (c *Ctx) SetLines(newLines []Line) {
 	c.linesMutex.Lock()
 	defer c.linesMutex.Unlock()
-	c.lines = newLines
+	c.lines.Reset(newLines)
+	c.linesGeneration++
+	c.linesReplaced++
 }
 
+// GetLinesGeneration returns a number that changes every time the
+// lines are changed via SetLines
+func (c *Ctx) GetLinesGeneration() uint64 {
+	c.linesMutex.Lock()
+	defer c.linesMutex.Unlock()
+	return c.linesGeneration
+}
+
+// GetLines returns the lines in the buffer. The slice is not changed
+// when lines come in later, and must not be modified
 func (c *Ctx) GetLines() []Line {
 	c.linesMutex.Lock()
 	defer c.linesMutex.Unlock()
-	return c.lines[:]
+	return c.lines.Lines()
 }
 
 func (c *Ctx) GetLinesCount() int {
 	c.linesMutex.Lock()
 	defer c.linesMutex.Unlock()
-	return len(c.lines)
+	return c.lines.Len()
+}
+
+// AppendLine adds a line at the end of the buffer, replacing the
+// oldest line if the buffer is full (--buffer-size). Several
+// BufferReaders may append lines concurrently
+func (c *Ctx) AppendLine(l Line) {
+	c.linesMutex.Lock()
+	defer c.linesMutex.Unlock()
+	c.lines.Append(l)
+	c.linesGeneration++
 }
 
-func (c *Ctx) IsBufferOverflowing() bool {
-	if c.bufferSize <= 0 {
+// appendLineSince is like AppendLine, but only adds the line if the
+// buffer hasn't been replaced since `replaced` (see SetLines). Returns
+// false if it has
+func (c *Ctx) appendLineSince(l Line, replaced uint64) bool {
+	c.linesMutex.Lock()
+	defer c.linesMutex.Unlock()
+	if c.linesReplaced != replaced {
 		return false
 	}
-
-	return len(c.lines) > c.bufferSize
+	c.lines.Append(l)
+	c.linesGeneration++
+	return true
 }
 
 func (c *Ctx) IsRangeMode() bool {
@@ -268,16 +429,29 @@ func (c *Ctx) SelectionLen() uint64 {
 	return c.selection.Len()
 }
 
+// SelectionAdd selects the x-th line (1 base) of the current results
 func (c *Ctx) SelectionAdd(x int) {
+	l := c.currentRow(x)
+	if l == nil {
+		return
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.selection.Add(x)
+	c.selection.Add(l)
 }
 
+// SelectionRemove unselects the x-th line (1 base) of the current
+// results
 func (c *Ctx) SelectionRemove(x int) {
+	l := c.currentRow(x)
+	if l == nil {
+		return
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.selection.Remove(x)
+	c.selection.Remove(l)
 }
 
 func (c *Ctx) SelectionClear() {
@@ -286,10 +460,34 @@ func (c *Ctx) SelectionClear() {
 	c.selection.Clear()
 }
 
+// SelectionContains returns true if the n-th line (1 base) of the
+// current results is selected
 func (c *Ctx) SelectionContains(n int) bool {
+	l := c.currentRow(n)
+	if l == nil {
+		return false
+	}
+	return c.IsSelected(l)
+}
+
+// IsSelected returns true if the line is selected. The line may be
+// any of the lines that were created from the same line of the input
+func (c *Ctx) IsSelected(l Line) bool {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	return c.selection.Has(n)
+	return c.selection.Has(l)
+}
+
+// currentRow returns the n-th line (1 base) of the current results,
+// or nil if there is no such line
+func (c *Ctx) currentRow(n int) Line {
+	c.currentMutex.Lock()
+	defer c.currentMutex.Unlock()
+
+	if n < 1 || len(c.current) < n {
+		return nil
+	}
+	return c.current[n-1]
 }
 
 func (c *Ctx) GetCurrent() []Line {
@@ -310,6 +508,150 @@ func (c *Ctx) SetCurrent(newMatches []Line) {
 	c.current = newMatches
 }
 
+// SetSourceCommand sets the command that peco.Reload runs to replace
+// the buffer
+func (c *Ctx) SetSourceCommand(s *SourceCommand) {
+	c.source = s
+}
+
+// WithFilename returns true if the name of the input of each line
+// should be displayed and output before it (--with-filename)
+func (c *Ctx) WithFilename() bool {
+	return c.withFilename
+}
+
+func (c *Ctx) SetWithFilename(b bool) {
+	c.withFilename = b
+}
+
+// InputDelimiter returns the string that separates the lines of the
+// input (--input-delimiter, --read0). It is empty if the lines are
+// separated by newlines
+func (c *Ctx) InputDelimiter() string {
+	return c.inputDelimiter
+}
+
+func (c *Ctx) SetInputDelimiter(d string) {
+	c.inputDelimiter = d
+}
+
+// InputEncoding returns the name of the encoding that the input is
+// converted from (--input-encoding). It is empty if the input is used
+// as is, which is the same as UTF-8
+func (c *Ctx) InputEncoding() string {
+	return c.inputEncoding
+}
+
+func (c *Ctx) SetInputEncoding(name string) error {
+	if name != "" && !IsValidInputEncoding(name) {
+		return fmt.Errorf("unknown input encoding '%s'", name)
+	}
+	c.inputEncoding = name
+	return nil
+}
+
+// SetOutputUTF8 makes the selected lines be output in UTF-8, instead
+// of the encoding of their input (--output-utf8)
+func (c *Ctx) SetOutputUTF8(b bool) {
+	c.outputUTF8 = b
+}
+
+// setSourceEncoding remembers the encoding that the input called
+// source was converted from, as each input may be in a different one
+func (c *Ctx) setSourceEncoding(source string, enc encoding.Encoding) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.encodings[source] = enc
+}
+
+// OutputRecord returns what is printed for the line when it has been
+// selected: its output, with the name of its input (--with-filename)
+// and its position in it (--print-index) before it, followed by the
+// input delimiter or a newline. The record is built in UTF-8, and then
+// converted to the encoding of the input as a whole, unless
+// --output-utf8 was given
+func (c *Ctx) OutputRecord(l Line) string {
+	record := l.Output()
+	if c.printIndex && l.Index() >= 0 {
+		record = strconv.Itoa(l.Index()) + ":" + record
+	}
+	if c.withFilename && l.Source() != "" {
+		record = l.Source() + ":" + record
+	}
+	switch {
+	case c.inputDelimiter != "":
+		record = record + c.inputDelimiter
+	case !strings.HasSuffix(record, "\n"):
+		record = record + "\n"
+	}
+
+	if c.outputUTF8 {
+		return record
+	}
+	c.mutex.Lock()
+	enc := c.encodings[l.Source()]
+	c.mutex.Unlock()
+	return encodeOutput(record, enc)
+}
+
+// SetPrintIndex makes the position of each line in its input be output
+// before it (--print-index)
+func (c *Ctx) SetPrintIndex(b bool) {
+	c.printIndex = b
+}
+
+// ANSI returns true if the colors given by ANSI sequences in the
+// input should be displayed (--ansi), instead of being stripped
+func (c *Ctx) ANSI() bool {
+	return c.ansi
+}
+
+func (c *Ctx) SetANSI(b bool) {
+	c.ansi = b
+}
+
+// SetResult makes peco exit with the given lines as its output, as if
+// they had been selected
+func (c *Ctx) SetResult(lines []Line) {
+	ch := make(chan Line, len(lines))
+	for _, l := range lines {
+		ch <- l
+	}
+	close(ch)
+	c.resultCh = ch
+}
+
+// MatchLines runs the query against the lines with the current
+// matcher, outside of the Filter. This is used to decide what to do
+// before the user interface is displayed (--select-1)
+func (c *Ctx) MatchLines(query string, lines []Line) ([]Line, error) {
+	return c.matchLines(c.Matcher(), make(chan struct{}, 1), query, lines)
+}
+
+// matchLines runs the matcher, restricted to the fields given with
+// --match-fields if any
+func (c *Ctx) matchLines(m Matcher, quit chan struct{}, query string, lines []Line) ([]Line, error) {
+	if s := c.fieldSelector; s != nil {
+		return s.Line(m, quit, query, lines)
+	}
+	return runMatcher(m, quit, query, lines)
+}
+
+// LinePositions returns the positions in the buffer of the current
+// matches, as set by SetLinePositions. Lines that are not in the map
+// are displayed without context
+func (c *Ctx) LinePositions() map[Line]int {
+	c.currentMutex.Lock()
+	defer c.currentMutex.Unlock()
+	return c.linePositions
+}
+
+func (c *Ctx) SetLinePositions(positions map[Line]int) {
+	c.currentMutex.Lock()
+	defer c.currentMutex.Unlock()
+	c.linePositions = positions
+}
+
 func (c *Ctx) GetCurrentAt(i int) Line {
 	c.currentMutex.Lock()
 	defer c.currentMutex.Unlock()
@@ -356,15 +698,15 @@ func (c *Ctx) Refresh() {
 	c.DrawMatches(nil)
 }
 
+// Buffer returns the lines in the buffer. See GetLines
 func (c *Ctx) Buffer() []Line {
-	// Copy lines so it's safe to read it
-	lcopy := make([]Line, len(c.lines))
-	copy(lcopy, c.lines)
-	return lcopy
+	return c.GetLines()
 }
 
 func (c *Ctx) NewBufferReader(r io.ReadCloser) *BufferReader {
-	return &BufferReader{c, r, make(chan struct{})}
+	c.linesMutex.Lock()
+	defer c.linesMutex.Unlock()
+	return &BufferReader{c, r, make(chan struct{}), "", c.linesReplaced}
 }
 
 func (c *Ctx) NewView() *View {
@@ -379,14 +721,14 @@ func (c *Ctx) NewView() *View {
 }
 
 func (c *Ctx) NewFilter() *Filter {
-	return &Filter{c, make(chan string)}
+	return &Filter{c, make(chan string), newQueryCache()}
 }
 
 func (c *Ctx) NewInput() *Input {
 	// Create a new keymap object
 	k := NewKeymap(c.config.Keymap, c.config.Action)
 	k.ApplyKeybinding()
-	return &Input{c, newMutex(), nil, k, []string{}}
+	return &Input{c, newMutex(), nil, k, []string{}, false}
 }
 
 func (c *Ctx) SetSavedQuery(q []rune) {
@@ -407,12 +749,25 @@ func (c *Ctx) Matcher() Matcher {
 }
 
 func (c *Ctx) LoadCustomMatcher() error {
+	for name := range c.config.CustomMatcherOptions {
+		if _, ok := c.config.CustomMatcher[name]; !ok {
+			return fmt.Errorf("options given for unknown custom matcher '%s'", name)
+		}
+	}
+
 	if len(c.config.CustomMatcher) == 0 {
 		return nil
 	}
 
 	for name, args := range c.config.CustomMatcher {
-		if err := c.MatcherSet.Add(NewCustomMatcher(c.enableSep, name, args)); err != nil {
+		m := NewCustomMatcher(c.enableSep, name, args)
+		if opts, ok := c.config.CustomMatcherOptions[name]; ok {
+			m.SetFormat(opts.Format)
+			if opts.Server {
+				m.EnableServer()
+			}
+		}
+		if err := c.MatcherSet.Add(m); err != nil {
 			return err
 		}
 	}
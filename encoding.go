@@ -0,0 +1,289 @@
+package peco
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// AutoEncoding is the --input-encoding that guesses the encoding of
+// each input from its first bytes
+const AutoEncoding = "auto"
+
+// encodingSampleSize is the maximum number of bytes that are looked
+// at to guess the encoding of an input
+const encodingSampleSize = 64 * 1024
+
+var (
+	utf16LE = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	utf16BE = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+)
+
+// inputEncodings are the encodings that --input-encoding accepts. A nil
+// Encoding means UTF-8, which needs no conversion. "utf-16" is decided
+// by the byte order mark, if any
+var inputEncodings = map[string]encoding.Encoding{
+	"utf-8":       nil,
+	"utf8":        nil,
+	"shift_jis":   japanese.ShiftJIS,
+	"sjis":        japanese.ShiftJIS,
+	"cp932":       japanese.ShiftJIS,
+	"euc-jp":      japanese.EUCJP,
+	"eucjp":       japanese.EUCJP,
+	"iso-2022-jp": japanese.ISO2022JP,
+	"jis":         japanese.ISO2022JP,
+	"utf-16":      utf16LE,
+	"utf-16le":    utf16LE,
+	"utf-16be":    utf16BE,
+	"latin-1":     charmap.ISO8859_1,
+	"latin1":      charmap.ISO8859_1,
+	"iso-8859-1":  charmap.ISO8859_1,
+}
+
+// IsValidInputEncoding checks if name can be used with --input-encoding
+func IsValidInputEncoding(name string) bool {
+	name = strings.ToLower(name)
+	if name == AutoEncoding {
+		return true
+	}
+	_, ok := inputEncodings[name]
+	return ok
+}
+
+// decodeInput converts the input to UTF-8 from the encoding called
+// name, guessing it if name is AutoEncoding. The encoding that is used
+// is returned, so that the output can be converted back to it. It is
+// nil for UTF-8
+func decodeInput(r io.Reader, name string) (io.Reader, encoding.Encoding, error) {
+	name = strings.ToLower(name)
+	if name == "" {
+		return r, nil, nil
+	}
+
+	enc, ok := inputEncodings[name]
+	if !ok && name != AutoEncoding {
+		return nil, nil, fmt.Errorf("unknown input encoding '%s'", name)
+	}
+
+	// Look at whatever comes first, as waiting for the whole sample
+	// would hold back inputs that are streamed slowly
+	sample := make([]byte, encodingSampleSize)
+	n, err := io.ReadAtLeast(r, sample, 1)
+	if err != nil {
+		if err == io.EOF {
+			return r, enc, nil
+		}
+		return nil, nil, err
+	}
+	sample = sample[:n]
+
+	skip := 0
+	switch name {
+	case AutoEncoding:
+		enc, skip = detectEncoding(sample)
+	case "utf-16":
+		enc, skip = utf16LE, 0
+		if e, n := detectBOM(sample); e != nil {
+			enc, skip = e, n
+		}
+	default:
+		if e, n := detectBOM(sample); e == enc {
+			skip = n
+		}
+	}
+
+	r = io.MultiReader(bytes.NewReader(sample[skip:]), r)
+	if enc == nil {
+		return r, nil, nil
+	}
+	return transform.NewReader(r, enc.NewDecoder()), enc, nil
+}
+
+// detectBOM returns the encoding that the byte order mark at the start
+// of sample stands for, and the length of the mark. UTF-8 is returned
+// as nil, like when there is no mark, but with a length of 3
+func detectBOM(sample []byte) (encoding.Encoding, int) {
+	switch {
+	case bytes.HasPrefix(sample, utf8BOM):
+		return nil, len(utf8BOM)
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return utf16LE, 2
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return utf16BE, 2
+	}
+	return nil, 0
+}
+
+// detectEncoding guesses the encoding of sample, and returns it along
+// with the length of its byte order mark
+func detectEncoding(sample []byte) (encoding.Encoding, int) {
+	if enc, n := detectBOM(sample); n > 0 {
+		return enc, n
+	}
+
+	// ISO-2022-JP is 7 bit, so it must be looked for before UTF-8
+	for _, esc := range []string{"\x1b$B", "\x1b$@", "\x1b(J", "\x1b(I"} {
+		if bytes.Contains(sample, []byte(esc)) {
+			return japanese.ISO2022JP, 0
+		}
+	}
+
+	// As is UTF-16 (for the most part) without a byte order mark
+	if enc := detectUTF16(sample); enc != nil {
+		return enc, 0
+	}
+
+	if utf8.Valid(trimPartialRune(sample)) {
+		return nil, 0
+	}
+
+	sjis, euc := isShiftJIS(sample), isEUCJP(sample)
+	switch {
+	case sjis && euc:
+		// EUC-JP text also reads as Shift_JIS, but mostly as half
+		// width katakana, which are rare in actual Shift_JIS text
+		if hasHalfWidthKatakana(sample) {
+			return japanese.EUCJP, 0
+		}
+		return japanese.ShiftJIS, 0
+	case sjis:
+		return japanese.ShiftJIS, 0
+	case euc:
+		return japanese.EUCJP, 0
+	}
+
+	// Any byte is a valid character in Latin-1
+	return charmap.ISO8859_1, 0
+}
+
+// detectUTF16 returns the UTF-16 encoding of sample if it looks like
+// text in a latin script, where every other byte is 0
+func detectUTF16(sample []byte) encoding.Encoding {
+	pairs := len(sample) / 2
+	if pairs == 0 {
+		return nil
+	}
+
+	even, odd := 0, 0
+	for i := 0; i+1 < len(sample); i += 2 {
+		if sample[i] == 0 {
+			even++
+		}
+		if sample[i+1] == 0 {
+			odd++
+		}
+	}
+	switch {
+	case odd*2 > pairs && even*10 < pairs:
+		return utf16LE
+	case even*2 > pairs && odd*10 < pairs:
+		return utf16BE
+	}
+	return nil
+}
+
+// trimPartialRune drops the incomplete character at the end of sample,
+// if any, as the sample may end in the middle of one
+func trimPartialRune(sample []byte) []byte {
+	for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(sample[i]) {
+			if !utf8.FullRune(sample[i:]) {
+				return sample[:i]
+			}
+			break
+		}
+	}
+	return sample
+}
+
+// isShiftJIS checks whether all of the bytes in sample make up Shift_JIS
+// characters. A character that is cut off at the end is fine
+func isShiftJIS(sample []byte) bool {
+	for i := 0; i < len(sample); i++ {
+		b := sample[i]
+		switch {
+		case b < 0x80, b >= 0xA1 && b <= 0xDF:
+		case (b >= 0x81 && b <= 0x9F) || (b >= 0xE0 && b <= 0xFC):
+			i++
+			if i < len(sample) {
+				t := sample[i]
+				if t < 0x40 || t == 0x7F || t > 0xFC {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isEUCJP checks whether all of the bytes in sample make up EUC-JP
+// characters. A character that is cut off at the end is fine
+func isEUCJP(sample []byte) bool {
+	inRange := func(i int, lo, hi byte) bool {
+		return i >= len(sample) || (sample[i] >= lo && sample[i] <= hi)
+	}
+	for i := 0; i < len(sample); i++ {
+		b := sample[i]
+		switch {
+		case b < 0x80:
+		case b == 0x8E: // half width katakana
+			if !inRange(i+1, 0xA1, 0xDF) {
+				return false
+			}
+			i++
+		case b == 0x8F: // JIS X 0212
+			if !inRange(i+1, 0xA1, 0xFE) || !inRange(i+2, 0xA1, 0xFE) {
+				return false
+			}
+			i += 2
+		case b >= 0xA1 && b <= 0xFE:
+			if !inRange(i+1, 0xA1, 0xFE) {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// hasHalfWidthKatakana checks whether sample, read as Shift_JIS,
+// contains half width katakana
+func hasHalfWidthKatakana(sample []byte) bool {
+	for i := 0; i < len(sample); i++ {
+		b := sample[i]
+		switch {
+		case b >= 0xA1 && b <= 0xDF:
+			return true
+		case (b >= 0x81 && b <= 0x9F) || (b >= 0xE0 && b <= 0xFC):
+			i++
+		}
+	}
+	return false
+}
+
+// encodeOutput converts s back to the encoding of the input
+func encodeOutput(s string, enc encoding.Encoding) string {
+	if enc == nil {
+		return s
+	}
+	out, err := enc.NewEncoder().String(s)
+	if err != nil {
+		// Characters that can't be converted back, such as those
+		// that were invalid in the input, are output as UTF-8
+		return s
+	}
+	return out
+}
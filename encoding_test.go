@@ -0,0 +1,146 @@
+package peco
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func encodeString(t *testing.T, enc encoding.Encoding, s string) string {
+	out, err := enc.NewEncoder().String(s)
+	if err != nil {
+		t.Fatalf("Failed to encode '%s': %s", s, err)
+	}
+	return out
+}
+
+func TestDetectEncoding(t *testing.T) {
+	text := "日本語のテキスト\nもう一行\n"
+	tests := []struct {
+		name     string
+		input    string
+		expected encoding.Encoding
+		skip     int
+	}{
+		{"UTF-8", text, nil, 0},
+		{"UTF-8 with BOM", "\xEF\xBB\xBF" + text, nil, 3},
+		{"ASCII", "hello\nworld\n", nil, 0},
+		{"Shift_JIS", encodeString(t, japanese.ShiftJIS, text), japanese.ShiftJIS, 0},
+		{"EUC-JP", encodeString(t, japanese.EUCJP, text), japanese.EUCJP, 0},
+		{"ISO-2022-JP", encodeString(t, japanese.ISO2022JP, text), japanese.ISO2022JP, 0},
+		{"UTF-16LE with BOM", "\xFF\xFE" + encodeString(t, utf16LE, text), utf16LE, 2},
+		{"UTF-16BE with BOM", "\xFE\xFF" + encodeString(t, utf16BE, text), utf16BE, 2},
+		{"UTF-16LE", encodeString(t, utf16LE, "plain text\n"), utf16LE, 0},
+		{"Latin-1", encodeString(t, charmap.ISO8859_1, "Crème brûlée, café\n"), charmap.ISO8859_1, 0},
+		{"NUL separated", "foo\x00bar baz\x00qux\x00", nil, 0},
+	}
+
+	for _, test := range tests {
+		enc, skip := detectEncoding([]byte(test.input))
+		if enc != test.expected || skip != test.skip {
+			t.Errorf("%s: expected %v (skip %d), got %v (skip %d)", test.name, test.expected, test.skip, enc, skip)
+		}
+	}
+
+	// A sample may end in the middle of a character
+	if enc, _ := detectEncoding([]byte(text)[:4]); enc != nil {
+		t.Errorf("Expected a truncated UTF-8 sample to be detected as UTF-8, got %v", enc)
+	}
+}
+
+func TestReaderEncoding(t *testing.T) {
+	expected := []string{"日本語", "テキスト"}
+	tests := []struct {
+		name  string
+		input string
+		enc   encoding.Encoding
+	}{
+		{"auto", encodeString(t, japanese.ShiftJIS, "日本語\r\nテキスト\r\n"), japanese.ShiftJIS},
+		{"euc-jp", encodeString(t, japanese.EUCJP, "日本語\nテキスト\n"), japanese.EUCJP},
+		{"utf-16", "\xFE\xFF" + encodeString(t, utf16BE, "日本語\nテキスト\n"), utf16BE},
+		{"", "日本語\nテキスト\n", nil},
+	}
+
+	for _, test := range tests {
+		ctx := NewCtx(nil)
+		if err := ctx.SetInputEncoding(test.name); err != nil {
+			t.Fatalf("Failed to set the input encoding '%s': %s", test.name, err)
+		}
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader(test.input)))
+		rdr.SetSource("input")
+		ctx.AddWaitGroup(1)
+		go rdr.Loop()
+		WaitInputDone([]*BufferReader{rdr})
+
+		lines := ctx.GetLines()
+		got := []string{}
+		for _, l := range lines {
+			got = append(got, l.Buffer())
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Encoding '%s': expected lines %q, got %q", test.name, expected, got)
+			continue
+		}
+
+		// The output is converted back to the encoding of the input
+		out := ctx.OutputRecord(lines[0])
+		if want := encodeOutput(expected[0]+"\n", test.enc); out != want {
+			t.Errorf("Encoding '%s': expected output %q, got %q", test.name, want, out)
+		}
+		ctx.SetOutputUTF8(true)
+		if out := ctx.OutputRecord(lines[0]); out != expected[0]+"\n" {
+			t.Errorf("Encoding '%s': expected UTF-8 output %q, got %q", test.name, expected[0]+"\n", out)
+		}
+	}
+
+	if err := NewCtx(nil).SetInputEncoding("klingon"); err == nil {
+		t.Errorf("Expected an unknown encoding to be rejected")
+	}
+}
+
+func TestOutputRecordUTF16(t *testing.T) {
+	text := "日本語\nテキスト\n"
+	tests := []struct {
+		delimiter    string
+		withFilename bool
+		printIndex   bool
+		expected     string
+	}{
+		{"", false, false, text},
+		{"", true, true, "input:0:日本語\ninput:1:テキスト\n"},
+		{"\x00", false, true, "0:日本語\x001:テキスト\x00"},
+	}
+
+	for _, test := range tests {
+		input := text
+		if test.delimiter != "" {
+			input = strings.Replace(text, "\n", test.delimiter, -1)
+		}
+
+		ctx := NewCtx(nil)
+		ctx.SetInputEncoding(AutoEncoding)
+		ctx.SetInputDelimiter(test.delimiter)
+		ctx.SetWithFilename(test.withFilename)
+		ctx.SetPrintIndex(test.printIndex)
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("\xFF\xFE" + encodeString(t, utf16LE, input))))
+		rdr.SetSource("input")
+		ctx.AddWaitGroup(1)
+		go rdr.Loop()
+		WaitInputDone([]*BufferReader{rdr})
+
+		// Whole records are written back in UTF-16, including the
+		// prefixes and the delimiters
+		out := ""
+		for _, l := range ctx.GetLines() {
+			out += ctx.OutputRecord(l)
+		}
+		if want := encodeString(t, utf16LE, test.expected); out != want {
+			t.Errorf("Expected output %q (%q in UTF-16), got %q", want, test.expected, out)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package peco
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// fieldRange is a range of fields, 1 based. Negative numbers count
+// from the last field, and zero means "unbounded"
+type fieldRange struct {
+	from int
+	to   int
+}
+
+// FieldSelector restricts matching to some of the fields (columns)
+// in each line, such as the 2nd field through the end of the line
+// (--match-fields and --delimiter)
+type FieldSelector struct {
+	delimiter string // empty means fields are separated by whitespace
+	ranges    []fieldRange
+	enableSep bool
+}
+
+// NewFieldSelector creates a new FieldSelector. `spec` is a comma
+// separated list of field numbers (1 based) or ranges of them, such
+// as "1,3", "2..", "..3" or "2..4". Negative numbers count from the
+// end, so "-1" is the last field. An empty `delimiter` splits fields
+// by whitespace, like awk does
+func NewFieldSelector(delimiter, spec string, enableSep bool) (*FieldSelector, error) {
+	ranges := []fieldRange{}
+	for _, s := range strings.Split(spec, ",") {
+		r, err := parseFieldRange(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+
+	if delimiter == `\t` {
+		delimiter = "\t"
+	}
+
+	return &FieldSelector{delimiter, ranges, enableSep}, nil
+}
+
+func parseFieldNumber(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid field number '%s'", s)
+	}
+	return n, nil
+}
+
+func parseFieldRange(s string) (fieldRange, error) {
+	if s == "" {
+		return fieldRange{}, fmt.Errorf("empty field specification")
+	}
+
+	i := strings.Index(s, "..")
+	if i < 0 {
+		n, err := parseFieldNumber(s)
+		if err != nil {
+			return fieldRange{}, err
+		}
+		return fieldRange{n, n}, nil
+	}
+
+	from, err := parseFieldNumber(s[:i])
+	if err != nil {
+		return fieldRange{}, err
+	}
+	to, err := parseFieldNumber(s[i+2:])
+	if err != nil {
+		return fieldRange{}, err
+	}
+	return fieldRange{from, to}, nil
+}
+
+// fields returns the byte offsets of each field in line
+func (s *FieldSelector) fields(line string) [][]int {
+	fields := [][]int{}
+	if s.delimiter != "" {
+		start := 0
+		for {
+			i := strings.Index(line[start:], s.delimiter)
+			if i < 0 {
+				break
+			}
+			fields = append(fields, []int{start, start + i})
+			start += i + len(s.delimiter)
+		}
+		return append(fields, []int{start, len(line)})
+	}
+
+	start := -1
+	for i, r := range line {
+		if unicode.IsSpace(r) {
+			if start > -1 {
+				fields = append(fields, []int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start > -1 {
+		fields = append(fields, []int{start, len(line)})
+	}
+	return fields
+}
+
+// Segments returns the byte offsets of the selected fields in line.
+// Ranges of fields are returned as a single segment, including the
+// delimiters in between them
+func (s *FieldSelector) Segments(line string) [][]int {
+	fields := s.fields(line)
+	count := len(fields)
+	resolve := func(n, unbounded int) int {
+		switch {
+		case n == 0:
+			return unbounded
+		case n < 0:
+			return count + n + 1
+		}
+		return n
+	}
+
+	segments := [][]int{}
+	for _, r := range s.ranges {
+		from := resolve(r.from, 1)
+		to := resolve(r.to, count)
+		if from < 1 {
+			from = 1
+		}
+		if to > count {
+			to = count
+		}
+		if from > to {
+			continue
+		}
+		segments = append(segments, []int{fields[from-1][0], fields[to-1][1]})
+	}
+
+	// Sort and merge overlapping segments, so that they can be mapped
+	// back to the original line in order
+	sort.Sort(byStart(segments))
+	merged := [][]int{}
+	for _, seg := range segments {
+		if l := len(merged); l > 0 && seg[0] <= merged[l-1][1] {
+			if seg[1] > merged[l-1][1] {
+				merged[l-1][1] = seg[1]
+			}
+			continue
+		}
+		merged = append(merged, seg)
+	}
+	return merged
+}
+
+func (s *FieldSelector) joiner() string {
+	if s.delimiter == "" {
+		return " "
+	}
+	return s.delimiter
+}
+
+// Text returns the selected fields in line, which is what the
+// matchers are run against
+func (s *FieldSelector) Text(line string) string {
+	segments := s.Segments(line)
+	parts := make([]string, len(segments))
+	for i, seg := range segments {
+		parts[i] = line[seg[0]:seg[1]]
+	}
+	return strings.Join(parts, s.joiner())
+}
+
+// MapIndices translates indices into the text returned by Text()
+// into indices into the full line
+func (s *FieldSelector) MapIndices(line string, matches [][]int) [][]int {
+	if matches == nil {
+		return nil
+	}
+
+	segments := s.Segments(line)
+	jl := len(s.joiner())
+	mapped := [][]int{}
+	for _, m := range matches {
+		offset := 0 // where the current segment starts in the text
+		for _, seg := range segments {
+			l := seg[1] - seg[0]
+			start, end := m[0], m[1]
+			if start < offset {
+				start = offset
+			}
+			if end > offset+l {
+				end = offset + l
+			}
+			if start < end {
+				mapped = append(mapped, []int{seg[0] + start - offset, seg[0] + end - offset})
+			}
+			offset += l + jl
+		}
+	}
+
+	if len(mapped) == 0 {
+		return nil
+	}
+	return mapped
+}
+
+// fieldLine is passed to the matchers in place of the original line,
+// so that they only see the selected fields
+type fieldLine struct {
+	Line
+	text string
+}
+
+func (l fieldLine) DisplayString() string {
+	return l.text
+}
+
+// Line runs the matcher against the selected fields of each line in
+// `buffer`, and returns the matched lines with indices into the full
+// line. Custom matchers receive the full line, as there is no way to
+// map their output back to the original line
+func (s *FieldSelector) Line(m Matcher, quit chan struct{}, q string, buffer []Line) ([]Line, error) {
+	if _, ok := m.(*CustomMatcher); ok {
+		return runMatcher(m, quit, q, buffer)
+	}
+
+	scoped := make([]Line, len(buffer))
+	for i, l := range buffer {
+		scoped[i] = fieldLine{l, s.Text(l.DisplayString())}
+	}
+
+	results, err := runMatcher(m, quit, q, scoped)
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range results {
+		indices := s.MapIndices(l.DisplayString(), l.Indices())
+		results[i] = newMatchedLineFor(l, s.enableSep, indices)
+	}
+	return results, nil
+}
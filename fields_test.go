@@ -0,0 +1,76 @@
+package peco
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFieldSelectorSegments(t *testing.T) {
+	tests := []struct {
+		delimiter string
+		spec      string
+		line      string
+		text      string
+	}{
+		{"", "2", "  foo   bar baz", "bar"},
+		{"", "2..", "foo   bar baz", "bar baz"},
+		{"", "..2", "foo   bar baz", "foo   bar"},
+		{"", "1,3", "foo bar baz", "foo baz"},
+		{"", "-1", "foo bar baz", "baz"},
+		{"", "4", "foo bar baz", ""},
+		{`\t`, "2..", "foo bar\tbaz\tqux", "baz\tqux"},
+		{":", "1,3", "a:b::d", "a:"},
+	}
+
+	for _, test := range tests {
+		s, err := NewFieldSelector(test.delimiter, test.spec, false)
+		if err != nil {
+			t.Errorf("Failed to create selector for '%s': %s", test.spec, err)
+			continue
+		}
+		if text := s.Text(test.line); text != test.text {
+			t.Errorf("Fields '%s' of '%s': expected '%s', got '%s'", test.spec, test.line, test.text, text)
+		}
+	}
+
+	for _, spec := range []string{"", "0", "a", "1,,2", "1..x"} {
+		if _, err := NewFieldSelector("", spec, false); err == nil {
+			t.Errorf("Expected '%s' to be an invalid field specification", spec)
+		}
+	}
+}
+
+func TestFieldSelectorLine(t *testing.T) {
+	s, err := NewFieldSelector("", "2,4", false)
+	if err != nil {
+		t.Fatalf("Failed to create selector: %s", err)
+	}
+
+	buffer := []Line{
+		NewRawLine("80 nginx 8080 web", false),
+		NewRawLine("abc redis 6379 cache", false),
+		NewRawLine("def postgres 5432 db80", false),
+	}
+
+	results, _ := s.Line(NewIgnoreCaseMatcher(false), make(chan struct{}), "80", buffer)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+
+	if results[0].DisplayString() != buffer[2].DisplayString() {
+		t.Errorf("Expected '%s', got '%s'", buffer[2].DisplayString(), results[0].DisplayString())
+	}
+
+	expected := [][]int{{20, 22}}
+	if !reflect.DeepEqual(results[0].Indices(), expected) {
+		t.Errorf("Expected indices %v, got %v", expected, results[0].Indices())
+	}
+
+	// A phrase that spans the joined fields is split back into
+	// pieces in the original line
+	results, _ = s.Line(NewIgnoreCaseMatcher(false), make(chan struct{}), `"redis cache"`, buffer)
+	expected = [][]int{{4, 9}, {15, 20}}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Indices(), expected) {
+		t.Errorf("Expected indices %v, got %v", expected, results)
+	}
+}
@@ -1,9 +1,17 @@
 package peco
 
+import (
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
 // Filter is responsible for the actual "grep" part of peco
 type Filter struct {
 	*Ctx
-	jobs chan string
+	jobs  chan string
+	cache *queryCache
 }
 
 // Work is the actual work horse that that does the matching
@@ -15,12 +23,176 @@ func (f *Filter) Work(cancel chan struct{}, q HubReq) {
 		f.DrawMatches(nil)
 		return
 	}
-	f.SetCurrent(f.Matcher().Line(cancel, query, f.Buffer()))
+	matcher := f.Matcher()
+
+	// If the query only narrows down a query that we have already
+	// run, we can search through its results instead of the whole
+	// buffer. The generation must be read before the buffer, so that
+	// lines that come in while we're matching invalidate the cache
+	generation := f.GetLinesGeneration()
+	results, ok := f.cache.Get(matcher.String(), generation, query)
+	if !ok {
+		buffer, narrowed := f.cache.Narrow(matcher, generation, query)
+		if !narrowed {
+			buffer = f.Buffer()
+		}
+
+		// Watch for cancel requests ourselves, so that we know not to
+		// cache the partial results of a cancelled query
+		quit := make(chan struct{}, 1)
+		done := make(chan struct{})
+		cancelled := make(chan bool, 1)
+		go func() {
+			select {
+			case <-cancel:
+				quit <- struct{}{}
+				cancelled <- true
+			case <-done:
+				cancelled <- false
+			}
+		}()
+
+		var err error
+		results, err = f.matchLines(matcher, quit, query, buffer)
+		close(done)
+
+		if <-cancelled {
+			return
+		}
+		if err != nil {
+			// Keep displaying the last valid results, so that the
+			// screen doesn't go blank while the query is incomplete
+			f.SendStatusMsg(err.Error())
+			return
+		}
+		f.cache.Put(matcher.String(), generation, query, results)
+	}
+
+	if f.ContextLines() > 0 {
+		f.SetLinePositions(linePositions(f.GetLines(), results))
+	} else {
+		f.SetLinePositions(nil)
+	}
+
+	if f.IsRankingEnabled() {
+		// Rank a copy, as the cached results must stay in buffer order
+		ranked := make([]Line, len(results))
+		copy(ranked, results)
+		RankLines(ranked)
+		results = ranked
+	}
+	f.SetCurrent(results)
 	f.SendStatusMsg("")
-	f.SelectionClear()
 	f.DrawMatches(nil)
 }
 
+// linePositions finds where each of the results is in the buffer, so
+// that the lines around it can be displayed. Matchers create new
+// lines, which are mapped back by the IDs they keep (see Line.ID)
+func linePositions(buffer []Line, results []Line) map[Line]int {
+	wanted := make(map[uint64]Line, len(results))
+	for _, r := range results {
+		wanted[r.ID()] = r
+	}
+
+	positions := make(map[Line]int, len(results))
+	for i, l := range buffer {
+		if r, ok := wanted[l.ID()]; ok {
+			positions[r] = i
+		}
+	}
+	return positions
+}
+
+// maxQueryCacheSize is the number of query results that the Filter
+// remembers at any given time
+const maxQueryCacheSize = 16
+
+// queryCache remembers the results of the most recent queries, so that
+// when the user types more characters or deletes them, we don't have to
+// go through the whole buffer again. The cache is cleared when the
+// matcher or the buffer (as told by its generation) changes
+type queryCache struct {
+	mutex      sync.Locker
+	matcher    string
+	generation uint64
+	queries    []string // oldest first
+	results    map[string][]Line
+}
+
+func newQueryCache() *queryCache {
+	return &queryCache{
+		mutex:   newMutex(),
+		results: map[string][]Line{},
+	}
+}
+
+// resetIfStale must be called with the mutex held
+func (c *queryCache) resetIfStale(matcher string, generation uint64) {
+	if c.matcher == matcher && c.generation == generation {
+		return
+	}
+	c.matcher = matcher
+	c.generation = generation
+	c.queries = nil
+	c.results = map[string][]Line{}
+}
+
+// Get returns the cached results for the query
+func (c *queryCache) Get(matcher string, generation uint64, query string) ([]Line, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.resetIfStale(matcher, generation)
+	results, ok := c.results[query]
+	return results, ok
+}
+
+// Narrow looks for the longest cached query that `query` narrows down,
+// and returns its results. The matcher must implement NarrowingMatcher
+func (c *queryCache) Narrow(matcher Matcher, generation uint64, query string) ([]Line, bool) {
+	nm, ok := matcher.(NarrowingMatcher)
+	if !ok {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.resetIfStale(matcher.String(), generation)
+	var best string
+	var results []Line
+	found := false
+	for _, prev := range c.queries {
+		if len(prev) < len(best) || !nm.Narrows(prev, query) {
+			continue
+		}
+		best = prev
+		results = c.results[prev]
+		found = true
+	}
+	return results, found
+}
+
+// Put stores the results for the query, evicting the oldest entry
+// if the cache is full
+func (c *queryCache) Put(matcher string, generation uint64, query string, results []Line) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.resetIfStale(matcher, generation)
+	if _, ok := c.results[query]; ok {
+		return
+	}
+
+	if len(c.queries) >= maxQueryCacheSize {
+		delete(c.results, c.queries[0])
+		c.queries = c.queries[1:]
+	}
+	c.queries = append(c.queries, query)
+	c.results[query] = results
+}
+
 // Loop keeps watching for incoming queries, and upon receiving
 // a query, spawns a goroutine to do the heavy work. It also
 // checks for previously running queries, so we can avoid
@@ -48,3 +220,85 @@ func (f *Filter) Loop() {
 		}
 	}
 }
+
+// These are the weights used when scoring a matched line in RankLines()
+const (
+	scoreWordStart   = 10 // match starts at the beginning of a word
+	scoreContiguous  = 4  // each character after the first in a single match
+	maxStartPenalty  = 50 // cap on the penalty for matches far into the line
+	lengthPenaltyDiv = 8  // one point is taken for every this many bytes
+)
+
+// ScoreLine gives a score to how well the line matched the query,
+// based on the indices that the matcher returned. Higher is better.
+// Matches that start at a word boundary and long contiguous matches
+// score higher, while matches far into the line and long lines
+// score lower
+func ScoreLine(l Line) int {
+	matches := l.Indices()
+	if len(matches) == 0 {
+		return 0
+	}
+
+	line := l.DisplayString()
+	score := 0
+	for _, m := range matches {
+		if isWordStart(line, m[0]) {
+			score += scoreWordStart
+		}
+		if n := utf8.RuneCountInString(line[m[0]:m[1]]); n > 1 {
+			score += scoreContiguous * (n - 1)
+		}
+	}
+
+	start := matches[0][0]
+	if start > maxStartPenalty {
+		start = maxStartPenalty
+	}
+	score -= start
+	score -= len(line) / lengthPenaltyDiv
+
+	return score
+}
+
+func isWordStart(line string, pos int) bool {
+	if pos == 0 {
+		return true
+	}
+	prev, _ := utf8.DecodeLastRuneInString(line[:pos])
+	cur, _ := utf8.DecodeRuneInString(line[pos:])
+	if !unicode.IsLetter(prev) && !unicode.IsDigit(prev) {
+		return true
+	}
+	// camelCase boundaries count as word starts, too
+	return unicode.IsLower(prev) && unicode.IsUpper(cur)
+}
+
+type byScore struct {
+	lines  []Line
+	scores []int
+}
+
+func (s byScore) Len() int {
+	return len(s.lines)
+}
+
+func (s byScore) Swap(i, j int) {
+	s.lines[i], s.lines[j] = s.lines[j], s.lines[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+func (s byScore) Less(i, j int) bool {
+	return s.scores[i] > s.scores[j]
+}
+
+// RankLines sorts the lines in place, from the best match to the
+// worst as computed by ScoreLine(). Lines with the same score
+// are kept in their original order
+func RankLines(lines []Line) {
+	scores := make([]int, len(lines))
+	for i, l := range lines {
+		scores[i] = ScoreLine(l)
+	}
+	sort.Stable(byScore{lines, scores})
+}
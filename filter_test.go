@@ -0,0 +1,245 @@
+package peco
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRankLines(t *testing.T) {
+	m := NewIgnoreCaseMatcher(false)
+	buffer := []Line{
+		NewRawLine("src/vendor/github.com/foo/barmain.go", false),
+		NewRawLine("a/very/long/path/to/some/domain.go", false),
+		NewRawLine("main.go", false),
+		NewRawLine("cmd/main.go", false),
+	}
+
+	results := m.Line(make(chan struct{}), "main", buffer)
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+
+	RankLines(results)
+	expected := []string{
+		"main.go",
+		"cmd/main.go",
+		"a/very/long/path/to/some/domain.go",
+		"src/vendor/github.com/foo/barmain.go",
+	}
+	for i, l := range results {
+		if l.DisplayString() != expected[i] {
+			t.Errorf("Expected line %d to be '%s', got '%s'", i, expected[i], l.DisplayString())
+		}
+	}
+}
+
+func TestScoreLineWithoutIndices(t *testing.T) {
+	if s := ScoreLine(NewRawLine("Hello, World!", false)); s != 0 {
+		t.Errorf("Lines without indices should score 0, got %d", s)
+	}
+}
+
+// recordingMatcher records the size of the buffer that it was asked
+// to match against
+type recordingMatcher struct {
+	*IgnoreCaseMatcher
+	sizes []int
+}
+
+func (m *recordingMatcher) String() string {
+	return "Recording"
+}
+
+func (m *recordingMatcher) LineWithError(quit chan struct{}, q string, buffer []Line) ([]Line, error) {
+	m.sizes = append(m.sizes, len(buffer))
+	return m.IgnoreCaseMatcher.LineWithError(quit, q, buffer)
+}
+
+// drainChannels drains the channels that Filter.Work sends to, until
+// ctx is stopped. Status messages are sent to msgs, unless it is nil
+func drainChannels(ctx *Ctx, msgs chan string) {
+	go func() {
+		for {
+			select {
+			case <-ctx.LoopCh():
+				return
+			case r := <-ctx.DrawCh():
+				r.Done()
+			case r := <-ctx.StatusMsgCh():
+				if msgs != nil {
+					msgs <- r.data.(StatusMsgRequest).message
+				}
+				r.Done()
+			}
+		}
+	}()
+}
+
+func TestFilterNarrowing(t *testing.T) {
+	ctx := NewCtx(nil)
+	ctx.SetLines([]Line{
+		NewRawLine("foo", false),
+		NewRawLine("foobar", false),
+		NewRawLine("bar", false),
+		NewRawLine("baz", false),
+	})
+
+	m := &recordingMatcher{NewIgnoreCaseMatcher(false), nil}
+	ctx.MatcherSet.Add(m)
+	ctx.MatcherSet.SetCurrentByName(m.String())
+
+	drainChannels(ctx, nil)
+	defer ctx.Stop()
+
+	f := ctx.NewFilter()
+	run := func(q string) []Line {
+		f.Work(make(chan struct{}, 1), HubReq{q, nil})
+		return ctx.GetCurrent()
+	}
+
+	run("fo")
+	if l := len(run("foob")); l != 1 {
+		t.Errorf("Expected 1 result, got %d", l)
+	}
+	// Going back to a previous query doesn't run the matcher at all
+	if l := len(run("fo")); l != 2 {
+		t.Errorf("Expected 2 results, got %d", l)
+	}
+	// Narrowing starts from the longest query that it extends
+	run("foo ")
+
+	expected := []int{4, 2, 2}
+	if !reflect.DeepEqual(m.sizes, expected) {
+		t.Errorf("Expected the matcher to be run against %v lines, got %v", expected, m.sizes)
+	}
+
+	// OR may match more lines, so it must search the whole buffer
+	m.sizes = nil
+	if l := len(run("foo | baz")); l != 3 {
+		t.Errorf("Expected 3 results, got %d", l)
+	}
+
+	// So must any query after the buffer has changed
+	ctx.SetLines(append(ctx.GetLines(), NewRawLine("food", false)))
+	if l := len(run("foo")); l != 3 {
+		t.Errorf("Expected 3 results, got %d", l)
+	}
+
+	expected = []int{4, 5}
+	if !reflect.DeepEqual(m.sizes, expected) {
+		t.Errorf("Expected the matcher to be run against %v lines, got %v", expected, m.sizes)
+	}
+}
+
+func TestFilterQueryError(t *testing.T) {
+	ctx := NewCtx(nil)
+	ctx.SetLines([]Line{
+		NewRawLine("foo(bar)", false),
+		NewRawLine("foo", false),
+		NewRawLine("bar", false),
+	})
+	ctx.MatcherSet.SetCurrentByName(RegexpMatch)
+
+	msgs := make(chan string, 10)
+	drainChannels(ctx, msgs)
+	defer ctx.Stop()
+
+	f := ctx.NewFilter()
+	f.Work(make(chan struct{}, 1), HubReq{"foo", nil})
+	if l := len(ctx.GetCurrent()); l != 2 {
+		t.Fatalf("Expected 2 results, got %d", l)
+	}
+	<-msgs
+
+	// The incomplete regular expression is reported, and the
+	// previous results are kept
+	f.Work(make(chan struct{}, 1), HubReq{`"foo("`, nil})
+	if l := len(ctx.GetCurrent()); l != 2 {
+		t.Errorf("Expected the previous 2 results to be kept, got %d", l)
+	}
+	expected := "invalid regular expression: missing closing ) (at position 1)"
+	if msg := <-msgs; msg != expected {
+		t.Errorf("Expected status message '%s', got '%s'", expected, msg)
+	}
+}
+
+func TestNarrows(t *testing.T) {
+	tests := []struct {
+		matcher  NarrowingMatcher
+		prev     string
+		query    string
+		expected bool
+	}{
+		{NewIgnoreCaseMatcher(false), "foo", "foob", true},
+		{NewIgnoreCaseMatcher(false), "foo", "foo bar", true},
+		{NewIgnoreCaseMatcher(false), "foo", "fo", false},
+		{NewIgnoreCaseMatcher(false), "foo", "foo !bar", false},
+		{NewSmartCaseMatcher(false), "foo", "fooB", true},
+		{NewRegexpMatcher(false), "fo", "fo*", false},
+		{NewFuzzyMatcher(false), "pc", "pcm", true},
+		{NewFuzzyMatcher(false), "pc", "pc !m", false},
+	}
+
+	for _, test := range tests {
+		if got := test.matcher.Narrows(test.prev, test.query); got != test.expected {
+			t.Errorf("%s: Narrows('%s', '%s') should be %v", test.matcher, test.prev, test.query, test.expected)
+		}
+	}
+}
+
+func TestLinePositions(t *testing.T) {
+	buffer := []Line{
+		NewRawLine("foo", false),
+		NewRawLine("bar", false),
+		NewRawLine("foo", false),
+	}
+	results := []Line{
+		newMatchedLineFor(buffer[0], false, [][]int{{0, 3}}),
+		newMatchedLineFor(buffer[2], false, [][]int{{0, 3}}),
+		NewMatchedLine("foo", false, [][]int{{0, 3}}),
+	}
+
+	positions := linePositions(buffer, results)
+	for i, expected := range []int{0, 2} {
+		if got, ok := positions[results[i]]; !ok || got != expected {
+			t.Errorf("Expected result %d to be at %d, got %d (%t)", i, expected, got, ok)
+		}
+	}
+	if _, ok := positions[results[2]]; ok {
+		t.Errorf("Expected a line that's not in the buffer to have no position")
+	}
+}
+
+func TestFilterKeepsSelection(t *testing.T) {
+	ctx := NewCtx(nil)
+	ctx.SetLines([]Line{
+		NewRawLine("foo", false),
+		NewRawLine("bar", false),
+		NewRawLine("foobar", false),
+	})
+
+	drainChannels(ctx, nil)
+	defer ctx.Stop()
+
+	f := ctx.NewFilter()
+	f.Work(make(chan struct{}, 1), HubReq{"bar", nil})
+	ctx.SelectionAdd(2) // "foobar"
+	if !ctx.SelectionContains(2) {
+		t.Fatalf("Expected the second result to be selected")
+	}
+
+	// The selected line moves to another row, but stays selected
+	f.Work(make(chan struct{}, 1), HubReq{"foo", nil})
+	if ctx.SelectionContains(1) || !ctx.SelectionContains(2) {
+		t.Errorf("Expected only 'foobar' to be selected")
+	}
+
+	// and so it does when it is not displayed
+	f.Work(make(chan struct{}, 1), HubReq{"foo !bar", nil})
+	if ctx.SelectionLen() != 1 {
+		t.Errorf("Expected the selection to be kept, got %d lines", ctx.SelectionLen())
+	}
+	if lines := ctx.selection.Lines(); len(lines) != 1 || lines[0].Buffer() != "foobar" {
+		t.Errorf("Expected 'foobar' to be selected, got %v", lines)
+	}
+}
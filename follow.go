@@ -0,0 +1,123 @@
+package peco
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// followInterval is how often a followed file is checked for changes
+// once we have read everything in it
+const followInterval = 250 * time.Millisecond
+
+// followReader reads a file like `tail -F` does (--follow): at the end
+// of the file it waits for more data instead of returning io.EOF. If
+// the file is truncated it is read again from the beginning, and if it
+// is replaced by another file, as log rotation does, the new file is read
+type followReader struct {
+	path   string
+	file   *os.File
+	offset int64
+	mutex  sync.Locker
+	done   chan struct{}
+}
+
+// NewFollowReader opens the file at path for following. Read only
+// returns io.EOF once the reader has been closed
+func NewFollowReader(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &followReader{path, f, 0, newMutex(), make(chan struct{})}, nil
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		case <-time.After(followInterval):
+		}
+		r.reopenIfChanged()
+	}
+}
+
+func (r *followReader) read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	select {
+	case <-r.done:
+		return 0, io.EOF
+	default:
+	}
+
+	n, err := r.file.Read(p)
+	r.offset += int64(n)
+	if n > 0 {
+		// Errors come up again on the next read
+		return n, nil
+	}
+	return n, err
+}
+
+// reopenIfChanged starts reading from the beginning of the file again
+// if it was truncated, or if another file has taken its place once the
+// old one has been read to the end
+func (r *followReader) reopenIfChanged() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		// The file may be in the middle of being rotated. Keep
+		// waiting, until someone creates it again
+		return
+	}
+
+	current, err := r.file.Stat()
+	if err == nil && os.SameFile(info, current) {
+		if info.Size() < r.offset {
+			if _, err := r.file.Seek(0, 0); err == nil {
+				r.offset = 0
+			}
+		}
+		return
+	}
+
+	// Another file has taken its place. What was written to the old
+	// one before it was rotated is read first
+	if err == nil && current.Size() > r.offset {
+		return
+	}
+
+	f, err := os.Open(r.path)
+	if err != nil {
+		return
+	}
+	r.file.Close()
+	r.file = f
+	r.offset = 0
+}
+
+// Close stops following the file. A Read that is waiting for more
+// data returns io.EOF
+func (r *followReader) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	close(r.done)
+	return r.file.Close()
+}
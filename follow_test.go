@@ -0,0 +1,98 @@
+package peco
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFollowReader(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("files that are open can't be renamed on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-follow")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "app.log")
+	write := func(flag int, content string) {
+		f, err := os.OpenFile(file, flag|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %s", file, err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatalf("Failed to write to %s: %s", file, err)
+		}
+	}
+	write(os.O_TRUNC, "first\n")
+
+	r, err := NewFollowReader(file)
+	if err != nil {
+		t.Fatalf("Failed to follow %s: %s", file, err)
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	expect := func(expected string) {
+		select {
+		case l := <-lines:
+			if l != expected {
+				t.Errorf("Expected line '%s', got '%s'", expected, l)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for line '%s'", expected)
+		}
+	}
+
+	expect("first")
+
+	// Appended lines
+	write(os.O_APPEND, "second\n")
+	expect("second")
+
+	// Truncated file
+	write(os.O_TRUNC, "third\n")
+	expect("third")
+
+	// Rotated file. Lines that were written to the old file just
+	// before it was rotated are not lost
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatalf("Failed to rename %s: %s", file, err)
+	}
+	old, err := os.OpenFile(file+".1", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", file+".1", err)
+	}
+	if _, err := old.WriteString("last\n"); err != nil {
+		t.Fatalf("Failed to write to %s: %s", file+".1", err)
+	}
+	old.Close()
+	write(os.O_TRUNC, "fourth\n")
+	expect("last")
+	expect("fourth")
+
+	r.Close()
+	select {
+	case l, ok := <-lines:
+		if ok {
+			t.Errorf("Expected no more lines after Close, got '%s'", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for the reader to stop")
+	}
+}
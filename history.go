@@ -0,0 +1,339 @@
+package peco
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxHistorySize is the number of queries that are remembered for
+// each history key
+const maxHistorySize = 1000
+
+const historyBasename = "history"
+
+// historyEntry is a line in the history file
+type historyEntry struct {
+	Key   string `json:"key,omitempty"`
+	Query string `json:"query"`
+}
+
+// History remembers the final queries of previous sessions, and lets
+// the user go back to them (peco.HistoryPrevious, peco.HistoryNext and
+// peco.HistorySearch). Queries are scoped by a key (--history-key), so
+// that different callers of peco may keep separate histories
+type History struct {
+	file    string
+	key     string
+	mutex   sync.Locker
+	entries []string // oldest first, only those for our key
+
+	// While the user goes through the history, pos is the index of
+	// the entry being displayed, and draft is the query that the user
+	// had typed before that. pos is len(entries) otherwise
+	pos   int
+	draft string
+	shown string // the query that we last put in the prompt
+
+	// While searching (peco.HistorySearch), term is what the entries
+	// must contain. The search goes back from the newest entry, and
+	// draft is the query to put back if it is cancelled
+	searching bool
+	term      string
+}
+
+// LocateHistoryFile returns the path to the history file. It is kept
+// in the same directory as the config file (see LocateRcfile), except
+// for the system wide directories. If neither a config file nor a
+// history file exist yet, the first of the directories is used
+func LocateHistoryFile() (string, error) {
+	dirs := configDirs(false)
+	if len(dirs) == 0 {
+		return "", os.ErrNotExist
+	}
+
+	for _, dir := range dirs {
+		for _, name := range []string{historyBasename, "config.json"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return filepath.Join(dir, historyBasename), nil
+			}
+		}
+	}
+	return filepath.Join(dirs[0], historyBasename), nil
+}
+
+// NewHistory creates a new History for queries with the given key,
+// which are stored in `file`
+func NewHistory(file, key string) *History {
+	return &History{
+		file:    file,
+		key:     key,
+		mutex:   newMutex(),
+		entries: []string{},
+	}
+}
+
+// readEntries reads all of the entries in the history file. Lines
+// that can't be parsed are skipped
+func (h *History) readEntries() ([]historyEntry, error) {
+	f, err := os.Open(h.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []historyEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := historyEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Load reads the queries for our key from the history file. A missing
+// file is not an error
+func (h *History) Load() error {
+	entries, err := h.readEntries()
+	if err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.entries = []string{}
+	for _, e := range entries {
+		if e.Key == h.key {
+			h.entries = appendHistory(h.entries, e.Query)
+		}
+	}
+	h.pos = len(h.entries)
+	return nil
+}
+
+// appendHistory appends the query to entries, removing the previous
+// occurrence of the same query, so that each query appears only once
+func appendHistory(entries []string, query string) []string {
+	for i, e := range entries {
+		if e == query {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	return append(entries, query)
+}
+
+// Add records the query in the history file. Entries for other keys
+// are kept, and only the most recent maxHistorySize entries for each
+// key are kept
+func (h *History) Add(query string) error {
+	if strings.TrimSpace(query) == "" {
+		return nil
+	}
+
+	entries, err := h.readEntries()
+	if err != nil {
+		return err
+	}
+	entries = append(entries, historyEntry{h.key, query})
+
+	// Go from the newest to the oldest, dropping duplicates and
+	// entries beyond the limit
+	counts := map[string]int{}
+	seen := map[historyEntry]bool{}
+	kept := make([]historyEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if seen[e] || counts[e.Key] >= maxHistorySize {
+			continue
+		}
+		seen[e] = true
+		counts[e.Key]++
+		kept = append(kept, e)
+	}
+
+	buf := []byte{}
+	for i := len(kept) - 1; i >= 0; i-- {
+		b, err := json.Marshal(kept[i])
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.file), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a concurrent peco
+	// never sees a half written file
+	tmp, err := ioutil.TempFile(filepath.Dir(h.file), historyBasename)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), h.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries = appendHistory(h.entries, query)
+	h.pos = len(h.entries)
+	return nil
+}
+
+// sync must be called with the mutex held. If the user has changed the
+// query that we displayed, we start going through the history again,
+// from the newest entry
+func (h *History) sync(current string) {
+	if h.pos < len(h.entries) && current == h.shown {
+		return
+	}
+	h.pos = len(h.entries)
+	h.draft = current
+}
+
+// show must be called with the mutex held
+func (h *History) show(pos int) string {
+	h.pos = pos
+	if pos == len(h.entries) {
+		h.shown = h.draft
+	} else {
+		h.shown = h.entries[pos]
+	}
+	return h.shown
+}
+
+// Previous returns the query that was used before the one being
+// displayed. `current` is the query in the prompt
+func (h *History) Previous(current string) (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.sync(current)
+	if h.pos == 0 {
+		return "", false
+	}
+	return h.show(h.pos - 1), true
+}
+
+// Next returns the query that was used after the one being displayed.
+// After the newest entry, the query that the user had typed is returned
+func (h *History) Next(current string) (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.sync(current)
+	if h.pos >= len(h.entries) {
+		return "", false
+	}
+	return h.show(h.pos + 1), true
+}
+
+// StartSearch starts an incremental search, like Ctrl-R in shells, for
+// the entries that contain `current`, the query in the prompt
+func (h *History) StartSearch(current string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.searching = true
+	h.term = current
+	h.draft = current
+	h.show(len(h.entries))
+}
+
+// Searching returns true while a search that was started with
+// StartSearch hasn't ended
+func (h *History) Searching() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.searching
+}
+
+// SearchTerm returns what the search is looking for
+func (h *History) SearchTerm() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.term
+}
+
+// SetSearchTerm changes what the search is looking for, and returns the
+// newest entry that contains it. The entry being displayed is kept if
+// there is none
+func (h *History) SetSearchTerm(term string) (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.term = term
+	return h.search(len(h.entries)-1, -1)
+}
+
+// SearchOlder returns the next older entry that matches the search
+func (h *History) SearchOlder() (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.search(h.pos-1, -1)
+}
+
+// SearchNewer returns the next newer entry that matches the search
+func (h *History) SearchNewer() (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.search(h.pos+1, 1)
+}
+
+// search must be called with the mutex held. It goes through the
+// entries from `start` in the direction of `step`
+func (h *History) search(start, step int) (string, bool) {
+	for i := start; i >= 0 && i < len(h.entries); i += step {
+		if strings.Contains(h.entries[i], h.term) {
+			return h.show(i), true
+		}
+	}
+	return "", false
+}
+
+// EndSearch ends the search, leaving the entry that was found in the
+// prompt. Previous and Next go on from there. It returns false if
+// there was no search to end
+func (h *History) EndSearch() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.searching {
+		return false
+	}
+	h.searching = false
+	return true
+}
+
+// CancelSearch ends the search, and returns the query that was in the
+// prompt when it started
+func (h *History) CancelSearch() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.searching = false
+	return h.show(len(h.entries))
+}
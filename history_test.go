@@ -0,0 +1,99 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "peco", "history")
+	h := NewHistory(file, "")
+	for _, q := range []string{"foo", "bar", "", "foo", "baz"} {
+		if err := h.Add(q); err != nil {
+			t.Fatalf("Failed to add to history: %s", err)
+		}
+	}
+	if err := NewHistory(file, "files").Add("main.go"); err != nil {
+		t.Fatalf("Failed to add to history: %s", err)
+	}
+
+	// Histories with different keys are kept apart, and duplicates
+	// are only kept as the most recent entry
+	h = NewHistory(file, "")
+	if err := h.Load(); err != nil {
+		t.Fatalf("Failed to load history: %s", err)
+	}
+	expected := []string{"bar", "foo", "baz"}
+	if !reflect.DeepEqual(h.entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, h.entries)
+	}
+
+	files := NewHistory(file, "files")
+	if err := files.Load(); err != nil {
+		t.Fatalf("Failed to load history: %s", err)
+	}
+	if !reflect.DeepEqual(files.entries, []string{"main.go"}) {
+		t.Errorf("Expected [main.go], got %v", files.entries)
+	}
+
+	// Going back and forth returns to what the user had typed
+	current := "ba"
+	steps := []struct {
+		move     func(string) (string, bool)
+		expected string
+		ok       bool
+	}{
+		{h.Previous, "baz", true},
+		{h.Previous, "foo", true},
+		{h.Previous, "bar", true},
+		{h.Previous, "", false},
+		{h.Next, "foo", true},
+		{h.Next, "baz", true},
+		{h.Next, "ba", true},
+		{h.Next, "", false},
+	}
+	for i, step := range steps {
+		q, ok := step.move(current)
+		if ok != step.ok || q != step.expected {
+			t.Errorf("Step %d: expected (%q, %v), got (%q, %v)", i, step.expected, step.ok, q, ok)
+		}
+		if ok {
+			current = q
+		}
+	}
+
+	// Searching looks for older entries containing what was typed
+	h.StartSearch("ba")
+	for _, expected := range []string{"baz", "bar"} {
+		q, ok := h.SearchOlder()
+		if !ok || q != expected {
+			t.Errorf("Expected search to find '%s', got (%q, %v)", expected, q, ok)
+		}
+	}
+	if _, ok := h.SearchOlder(); ok {
+		t.Errorf("Expected search to run out of matches")
+	}
+	if q, ok := h.SearchNewer(); !ok || q != "baz" {
+		t.Errorf("Expected search to go back to 'baz', got (%q, %v)", q, ok)
+	}
+	if q, ok := h.SetSearchTerm("f"); !ok || q != "foo" {
+		t.Errorf("Expected search for 'f' to find 'foo', got (%q, %v)", q, ok)
+	}
+	if q := h.CancelSearch(); q != "ba" || h.Searching() {
+		t.Errorf("Expected a cancelled search to return 'ba', got '%s'", q)
+	}
+
+	// Editing the query starts over
+	if q, _ := h.Previous("fo"); q != "baz" {
+		t.Errorf("Expected 'baz' after editing the query, got '%s'", q)
+	}
+}
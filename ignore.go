@@ -0,0 +1,157 @@
+package peco
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignorePattern is a pattern from a .gitignore file, or a glob given
+// with --walk-include or --walk-exclude. Patterns are matched against
+// paths relative to base, so that they can be collected from several
+// directories
+type ignorePattern struct {
+	base     string
+	segments []string
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+// parseIgnorePattern parses a line of a .gitignore file in the
+// directory base. It returns false for blank lines and comments
+func parseIgnorePattern(line, base string) (ignorePattern, bool) {
+	p := ignorePattern{base: base}
+
+	line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " ")
+	if line == "" || line[0] == '#' {
+		return p, false
+	}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' {
+		// "\#" and "\!" stand for themselves
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but at the end ties the pattern to base.
+	// Otherwise it matches names at any depth
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+	p.segments = strings.Split(line, "/")
+	return p, true
+}
+
+// readIgnoreFile reads the patterns in the .gitignore file in the
+// directory dir, if there is one
+func readIgnoreFile(dir string) []ignorePattern {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	patterns := []ignorePattern{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p, ok := parseIgnorePattern(scanner.Text(), dir); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// match checks whether the pattern matches the file at the absolute
+// path abs
+func (p ignorePattern) match(abs string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	rel, err := filepath.Rel(p.base, abs)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	names := strings.Split(filepath.ToSlash(rel), "/")
+	if !p.anchored {
+		names = names[len(names)-1:]
+	}
+	return matchSegments(p.segments, names)
+}
+
+// matchSegments matches a path against a pattern, both split at '/'.
+// "**" matches any number of directories
+func matchSegments(pattern, names []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// "foo/**" matches everything in foo, but not foo
+				return len(names) > 0
+			}
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(pattern, names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// isIgnored checks whether the file at the absolute path abs is
+// ignored. As with git, the last pattern that matches wins, so that
+// "!" can bring back files that were ignored before
+func isIgnored(patterns []ignorePattern, abs string, isDir bool) bool {
+	ignored := false
+	for _, p := range patterns {
+		if p.match(abs, isDir) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// parentIgnores collects the patterns of the .gitignore files in the
+// directories above dir, up to the top of the git repository that it
+// is in. Nothing is collected if dir is not in a repository
+func parentIgnores(dir string) []ignorePattern {
+	dirs := []string{}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			// Reached the root without finding a repository
+			return nil
+		}
+		d = parent
+		dirs = append(dirs, d)
+	}
+
+	// Patterns in deeper directories take precedence, so they go last
+	patterns := []ignorePattern{}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		patterns = append(patterns, readIgnoreFile(dirs[i])...)
+	}
+	return patterns
+}
@@ -14,6 +14,10 @@ type Input struct {
 	mod           *time.Timer
 	keymap        Keymap
 	currentKeySeq []string
+
+	// searchKept is set by the actions that go on with a history
+	// search (see doHistorySearch). Any other action ends it
+	searchKept bool
 }
 
 // Loop watches for incoming events from termbox, and pass them
@@ -74,7 +78,11 @@ func (i *Input) handleInputEvent(ev termbox.Event) {
 
 func (i *Input) handleKeyEvent(ev termbox.Event) {
 	if h := i.keymap.Handler(ev); h != nil {
+		i.searchKept = false
 		h.Execute(i, ev)
+		if !i.searchKept {
+			endHistorySearch(i)
+		}
 		return
 	}
 }
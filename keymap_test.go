@@ -4,21 +4,32 @@ import "testing"
 
 func TestSelection(t *testing.T) {
 	s := NewSelection()
+	first := NewRawLine("first", false)
+	second := NewRawLine("second", false)
 
-	s.Add(10)
+	s.Add(second)
 	if s.Len() != 1 {
 		t.Errorf("expected Len = 1, got %d", s.Len())
 	}
-	s.Add(1)
+	s.Add(first)
 	if s.Len() != 2 {
 		t.Errorf("expected Len = 2, got %d", s.Len())
 	}
-	s.Add(1)
+	// Lines created from a selected line are selected too
+	s.Add(newMatchedLineFor(first, false, nil))
 	if s.Len() != 2 {
 		t.Errorf("expected Len = 2, got %d", s.Len())
 	}
-	s.Remove(1)
+	if lines := s.Lines(); len(lines) != 2 || lines[0] != first || lines[1] != second {
+		t.Errorf("expected the lines in the order they were created, got %v", lines)
+	}
+	s.Remove(first)
 	if s.Len() != 1 {
 		t.Errorf("expected Len = 1, got %d", s.Len())
 	}
+
+	s.Invert([]Line{first, second})
+	if !s.Has(first) || s.Has(second) {
+		t.Errorf("expected only the first line to be selected after Invert")
+	}
 }
@@ -57,6 +57,23 @@ func mergeAttribute(a, b termbox.Attribute) termbox.Attribute {
 	return ((a - 1) | (b - 1)) + 1
 }
 
+// isControl returns true for the characters that printScreen can't
+// display as they are. Tabs are expanded instead
+func isControl(c rune) bool {
+	return c < ' ' && c != '\t'
+}
+
+// screenWidth returns the width of s when displayed with printScreen
+func screenWidth(s string) int {
+	w := runewidth.StringWidth(s)
+	for _, c := range s {
+		if isControl(c) {
+			w++
+		}
+	}
+	return w
+}
+
 // Utility function
 func printScreen(x, y int, fg, bg termbox.Attribute, msg string, fill bool) {
 	for len(msg) > 0 {
@@ -65,6 +82,11 @@ func printScreen(x, y int, fg, bg termbox.Attribute, msg string, fill bool) {
 			c = '?'
 			w = 1
 		}
+		if isControl(c) {
+			// Such as the newlines in records read with --read0.
+			// Displayed like ls does
+			c = '?'
+		}
 		msg = msg[w:]
 		if c == '\t' {
 			// In case we found a tab, we draw it as 4 spaces
@@ -89,6 +111,42 @@ func printScreen(x, y int, fg, bg termbox.Attribute, msg string, fill bool) {
 	}
 }
 
+// printANSI is like printScreen for line[start:end], but displays the
+// parts that were colored by ANSI sequences (see parseANSI) in their
+// colors. The attributes of fg, such as underline for the selected
+// line, are kept. The background is kept too if keepBG is true. It
+// returns the x after the printed text
+func printANSI(x, y int, fg, bg termbox.Attribute, line string, start, end int, spans []ansiSpan, keepBG, fill bool) int {
+	for _, s := range spans {
+		if s.end <= start || s.start >= end {
+			continue
+		}
+		if s.start > start {
+			printScreen(x, y, fg, bg, line[start:s.start], false)
+			x += screenWidth(line[start:s.start])
+			start = s.start
+		}
+
+		to := s.end
+		if to > end {
+			to = end
+		}
+		sfg, sbg := fg, bg
+		if s.fg != 0 {
+			sfg = s.fg | fg&ansiAttrMask
+		}
+		if s.bg != 0 && !keepBG {
+			sbg = s.bg
+		}
+		printScreen(x, y, sfg, sbg, line[start:to], false)
+		x += screenWidth(line[start:to])
+		start = to
+	}
+
+	printScreen(x, y, fg, bg, line[start:end], fill)
+	return x + screenWidth(line[start:end])
+}
+
 // AnchorSettings groups items that are required to control
 // where an anchored item is actually placed
 type AnchorSettings struct {
@@ -280,6 +338,9 @@ type ListArea struct {
 	*Ctx
 	*AnchorSettings
 	sortTopDown bool
+	// contextOffset is the index of the first match displayed when
+	// context lines are shown, as pages then hold fewer matches
+	contextOffset int
 }
 
 // NewListArea creates a new ListArea struct
@@ -288,69 +349,216 @@ func NewListArea(ctx *Ctx, anchor VerticalAnchor, anchorOffset int, sortTopDown
 		ctx,
 		NewAnchorSettings(anchor, anchorOffset),
 		sortTopDown,
+		0,
 	}
 }
 
-// Draw displays the ListArea on the screen
-func (l *ListArea) Draw(targets []Line, perPage int) {
-	currentPage := l.currentPage
+// lineY returns the row on the screen for the n-th line in the list
+func (l *ListArea) lineY(n int) int {
+	if l.sortTopDown {
+		return l.AnchorPosition() + n
+	}
+	return l.AnchorPosition() - n
+}
 
-	start := l.AnchorPosition()
+// lineStyle returns the attributes for the targetIdx-th match, `line`
+func (l *ListArea) lineStyle(targetIdx int, line Line) (termbox.Attribute, termbox.Attribute) {
+	switch {
+	case targetIdx == l.currentLine-1:
+		return l.config.Style.SelectedFG(), l.config.Style.SelectedBG()
+	case l.IsSelected(line):
+		return l.config.Style.SavedSelectionFG(), l.config.Style.SavedSelectionBG()
+	default:
+		return l.config.Style.BasicFG(), l.config.Style.BasicBG()
+	}
+}
 
-	var y int
-	var fgAttr, bgAttr termbox.Attribute
-	for n := 0; n < perPage; n++ {
-		switch {
-		case n+currentPage.offset == l.currentLine-1:
-			fgAttr = l.config.Style.SelectedFG()
-			bgAttr = l.config.Style.SelectedBG()
-		case l.SelectionContains(n + currentPage.offset + 1):
-			fgAttr = l.config.Style.SavedSelectionFG()
-			bgAttr = l.config.Style.SavedSelectionBG()
-		default:
-			fgAttr = l.config.Style.BasicFG()
-			bgAttr = l.config.Style.BasicBG()
+// Draw displays the ListArea on the screen
+func (l *ListArea) Draw(targets []Line, perPage int) {
+	if n := l.ContextLines(); n > 0 {
+		if positions := l.LinePositions(); len(positions) > 0 {
+			l.drawWithContext(targets, perPage, n, positions)
+			return
 		}
+	}
 
+	currentPage := l.currentPage
+	for n := 0; n < perPage; n++ {
 		targetIdx := currentPage.offset + n
 		if targetIdx >= len(targets) {
 			break
 		}
 
-		if l.sortTopDown {
-			y = n + start
-		} else {
-			y = start - n
+		fgAttr, bgAttr := l.lineStyle(targetIdx, targets[targetIdx])
+		l.drawLine(l.lineY(n), targets[targetIdx], fgAttr, bgAttr)
+	}
+}
+
+// drawSource displays the name of the input of the line, if asked to
+// (--with-filename), and returns the width that it took
+func (l *ListArea) drawSource(y int, target Line, fgAttr, bgAttr termbox.Attribute) int {
+	if !l.WithFilename() || target.Source() == "" {
+		return 0
+	}
+	prefix := target.Source() + ":"
+	printScreen(0, y, fgAttr, bgAttr, prefix, false)
+	return screenWidth(prefix)
+}
+
+// drawLine displays a line, highlighting the parts that matched
+func (l *ListArea) drawLine(y int, target Line, fgAttr, bgAttr termbox.Attribute) {
+	x := l.drawSource(y, target, fgAttr, bgAttr)
+	line := target.DisplayString()
+
+	// With --ansi, the parts that didn't match are displayed in the
+	// colors of the input. The background of the selected lines is
+	// kept, so that they still stand out
+	var spans []ansiSpan
+	if l.ANSI() {
+		line, spans = parseANSI(displayBuffer(target, l.enableSep))
+	}
+	keepBG := bgAttr != l.config.Style.BasicBG()
+
+	matches := target.Indices()
+	if matches == nil {
+		printANSI(x, y, fgAttr, bgAttr, line, 0, len(line), spans, keepBG, true)
+		return
+	}
+
+	prev := x
+	index := 0
+	for _, m := range matches {
+		if m[0] > index {
+			prev = printANSI(prev, y, fgAttr, bgAttr, line, index, m[0], spans, keepBG, false)
+			index = m[0]
 		}
+		c := line[m[0]:m[1]]
+		printScreen(prev, y, l.config.Style.MatchedFG(), mergeAttribute(bgAttr, l.config.Style.MatchedBG()), c, true)
+		prev += screenWidth(c)
+		index += len(c)
+	}
 
-		target := targets[targetIdx]
-		line := target.DisplayString()
-		matches := target.Indices()
-		if matches == nil {
-			printScreen(0, y, fgAttr, bgAttr, line, true)
-		} else {
-			prev := 0
-			index := 0
-			for _, m := range matches {
-				if m[0] > index {
-					c := line[index:m[0]]
-					printScreen(prev, y, fgAttr, bgAttr, c, false)
-					prev += runewidth.StringWidth(c)
-					index += len(c)
-				}
-				c := line[m[0]:m[1]]
-				printScreen(prev, y, l.config.Style.MatchedFG(), mergeAttribute(bgAttr, l.config.Style.MatchedBG()), c, true)
-				prev += runewidth.StringWidth(c)
-				index += len(c)
-			}
+	m := matches[len(matches)-1]
+	if m[0] > index {
+		printScreen(prev, y, l.config.Style.QueryFG(), mergeAttribute(bgAttr, l.config.Style.QueryBG()), line[m[0]:m[1]], true)
+	} else if len(line) > m[1] {
+		printANSI(prev, y, fgAttr, bgAttr, line, m[1], len(line), spans, keepBG, true)
+	}
+}
+
+// contextSeparator is displayed between groups of lines that are not
+// next to each other in the buffer
+const contextSeparator = "--"
+
+// contextRow is a row of the list when context lines are displayed.
+// match is the index of the row in the matches, or -1 for context
+// lines. line is nil for separators
+type contextRow struct {
+	line  Line
+	match int
+}
+
+// contextRows lays out the matches starting from targets[first], each
+// with up to n lines of buffer around it, until max rows are filled.
+// Groups that overlap or touch in the buffer are merged
+func contextRows(buffer, targets []Line, positions map[Line]int, first, n, max int) []contextRow {
+	rows := []contextRow{}
+	end := -1 // the buffer position after the last row, if known
+	for k := first; k < len(targets) && len(rows) < max; k++ {
+		target := targets[k]
+		pos, ok := positions[target]
+		if !ok || pos >= len(buffer) {
+			rows = append(rows, contextRow{target, k})
+			end = -1
+			continue
+		}
 
-			m := matches[len(matches)-1]
-			if m[0] > index {
-				printScreen(prev, y, l.config.Style.QueryFG(), mergeAttribute(bgAttr, l.config.Style.QueryBG()), line[m[0]:m[1]], true)
-			} else if len(line) > m[1] {
-				printScreen(prev, y, fgAttr, bgAttr, line[m[1]:len(line)], true)
+		start := pos - n
+		if start < 0 {
+			start = 0
+		}
+		if end > -1 && pos >= end && start <= end {
+			start = end
+		} else if len(rows) > 0 {
+			rows = append(rows, contextRow{nil, -1})
+		}
+		for p := start; p < pos; p++ {
+			rows = append(rows, contextRow{buffer[p], -1})
+		}
+		rows = append(rows, contextRow{target, k})
+
+		// Stop before the next match, so that it's not displayed twice
+		after := pos + n + 1
+		if after > len(buffer) {
+			after = len(buffer)
+		}
+		if k+1 < len(targets) {
+			if next, ok := positions[targets[k+1]]; ok && next > pos && next < after {
+				after = next
 			}
 		}
+		for p := pos + 1; p < after; p++ {
+			rows = append(rows, contextRow{buffer[p], -1})
+		}
+		end = after
+	}
+
+	if len(rows) > max {
+		rows = rows[:max]
+	}
+	return rows
+}
+
+func containsMatch(rows []contextRow, match int) bool {
+	for _, r := range rows {
+		if r.match == match {
+			return true
+		}
+	}
+	return false
+}
+
+// drawWithContext displays the matches with n lines of the buffer
+// before and after each of them. Context lines can't be selected: the
+// cursor and the selection still move between matches
+func (l *ListArea) drawWithContext(targets []Line, perPage, n int, positions map[Line]int) {
+	buffer := l.GetLines()
+	current := l.currentLine - 1
+	if current < 0 {
+		current = 0
+	}
+
+	first := l.contextOffset
+	if first > current {
+		first = current
+	}
+	rows := contextRows(buffer, targets, positions, first, n, perPage)
+	if !containsMatch(rows, current) {
+		// Scroll so that the current match is at the end of the page
+		first = current
+		// Each match takes at least a row, so no need to go further
+		// back than a page
+		for first > 0 && first > current-perPage && containsMatch(contextRows(buffer, targets, positions, first-1, n, perPage), current) {
+			first--
+		}
+		rows = contextRows(buffer, targets, positions, first, n, perPage)
+	}
+	l.contextOffset = first
+
+	fgContext := l.config.Style.ContextFG()
+	bgContext := l.config.Style.ContextBG()
+	for i, row := range rows {
+		y := l.lineY(i)
+		switch {
+		case row.line == nil:
+			printScreen(0, y, fgContext, bgContext, contextSeparator, true)
+		case row.match < 0:
+			x := l.drawSource(y, row.line, fgContext, bgContext)
+			printScreen(x, y, fgContext, bgContext, row.line.DisplayString(), true)
+		default:
+			fgAttr, bgAttr := l.lineStyle(row.match, row.line)
+			l.drawLine(y, row.line, fgAttr, bgAttr)
+		}
 	}
 }
 
@@ -1,6 +1,9 @@
 package peco
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"unicode/utf8"
 
@@ -118,3 +121,51 @@ func TestStatusBar(t *testing.T) {
 		return
 	}
 }
+
+func TestContextRows(t *testing.T) {
+	buffer := []Line{}
+	for i := 0; i < 10; i++ {
+		buffer = append(buffer, NewRawLine(fmt.Sprintf("line %d", i), false))
+	}
+
+	positions := map[Line]int{}
+	targets := []Line{}
+	for _, pos := range []int{2, 3, 8} {
+		l := NewMatchedLine(buffer[pos].Buffer(), false, [][]int{{0, 4}})
+		targets = append(targets, l)
+		positions[l] = pos
+	}
+
+	// Each row is either a buffer line number, a match ("m" followed
+	// by its index) or a separator
+	expected := []string{"1", "m0", "m1", "4", "--", "7", "m2", "9"}
+	describe := func(rows []contextRow) []string {
+		got := []string{}
+		for _, r := range rows {
+			switch {
+			case r.line == nil:
+				got = append(got, contextSeparator)
+			case r.match >= 0:
+				got = append(got, fmt.Sprintf("m%d", r.match))
+			default:
+				got = append(got, strings.TrimPrefix(r.line.Buffer(), "line "))
+			}
+		}
+		return got
+	}
+
+	rows := contextRows(buffer, targets, positions, 0, 1, 100)
+	if got := describe(rows); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected rows %v, got %v", expected, got)
+	}
+
+	rows = contextRows(buffer, targets, positions, 0, 1, 5)
+	if got := describe(rows); !reflect.DeepEqual(got, expected[:5]) {
+		t.Errorf("Expected rows %v, got %v", expected[:5], got)
+	}
+
+	rows = contextRows(buffer, targets, positions, 2, 1, 100)
+	if got := describe(rows); !reflect.DeepEqual(got, expected[5:]) {
+		t.Errorf("Expected rows %v, got %v", expected[5:], got)
+	}
+}
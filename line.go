@@ -1,15 +1,32 @@
 package peco
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
 
 // Global var used to strips ansi sequences
-var reANSIEscapeChars = regexp.MustCompile("\x1B\\[(?:[0-9]{1,2}(?:;[0-9]{1,2})?)*[a-zA-Z]")
+var reANSIEscapeChars = regexp.MustCompile("\x1B\\[[0-9;]*[a-zA-Z]")
 
 // Function who strips ansi sequences
 func stripANSISequence(s string) string {
 	return reANSIEscapeChars.ReplaceAllString(s, "")
 }
 
+// displayBuffer returns the part of the buffer of the line that is
+// displayed, before its ANSI sequences are stripped
+func displayBuffer(l Line, enableSep bool) string {
+	buf := l.Buffer()
+	if !enableSep {
+		return buf
+	}
+	if i := strings.LastIndex(buf, "\000"); i > -1 {
+		return buf[:i]
+	}
+	return buf
+}
+
 // Line defines the interface for each of the line that peco uses to display
 // and match against queries. Note that to make drawing easier,
 // we have a RawLine and MatchedLine types
@@ -18,13 +35,22 @@ type Line interface {
 	DisplayString() string // Line to be displayed
 	Output() string        // Output string to be displayed after peco is done
 	Indices() [][]int      // If the type allows, indices into matched portions of the string
+	Source() string        // Name of the input that the line was read from, if known
+	ID() uint64            // Unique ID of the line, kept by the lines that matched it
+	Index() int            // Position of the line in its input (0 base), or -1 if unknown
 }
 
+// lastLineID is the ID of the line that was created last
+var lastLineID uint64
+
 // baseLine is the common implementation between RawLine and MatchedLine
 type baseLine struct {
 	buf           string
 	sepLoc        int
 	displayString string
+	source        string
+	id            uint64
+	index         int
 }
 
 func newBaseLine(v string, enableSep bool) *baseLine {
@@ -32,6 +58,9 @@ func newBaseLine(v string, enableSep bool) *baseLine {
 		v,
 		-1,
 		"",
+		"",
+		atomic.AddUint64(&lastLineID, 1),
+		-1,
 	}
 	if !enableSep {
 		return m
@@ -65,6 +94,18 @@ func (m baseLine) DisplayString() string {
 	return m.displayString
 }
 
+func (m baseLine) Source() string {
+	return m.source
+}
+
+func (m baseLine) ID() uint64 {
+	return m.id
+}
+
+func (m baseLine) Index() int {
+	return m.index
+}
+
 func (m baseLine) Output() string {
 	if i := m.sepLoc; i > -1 {
 		return m.buf[i+1:]
@@ -100,6 +141,16 @@ func NewMatchedLine(v string, enableSep bool, m [][]int) *MatchedLine {
 	return &MatchedLine{newBaseLine(v, enableSep), m}
 }
 
+// newMatchedLineFor creates a MatchedLine for a line that was matched,
+// which remembers where the line came from, and takes over its ID
+func newMatchedLineFor(l Line, enableSep bool, m [][]int) *MatchedLine {
+	ml := NewMatchedLine(l.Buffer(), enableSep, m)
+	ml.source = l.Source()
+	ml.id = l.ID()
+	ml.index = l.Index()
+	return ml
+}
+
 // Indices returns the indices in the buffer that matched
 func (d MatchedLine) Indices() [][]int {
 	return d.matches
@@ -1,13 +1,17 @@
 package peco
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
 	"unicode"
+	"unicode/utf8"
 )
 
 type MatcherSet struct {
@@ -70,6 +74,33 @@ func (s *MatcherSet) Rotate() {
 	}
 }
 
+// ErrorMatcher is implemented by matchers that may fail to match,
+// e.g. because the query is not a valid regular expression.
+// LineWithError works like Line, but returns the error instead of an
+// empty result, so that the problem can be shown to the user instead
+// of silently matching nothing
+type ErrorMatcher interface {
+	LineWithError(chan struct{}, string, []Line) ([]Line, error)
+}
+
+// runMatcher runs the matcher, and returns the error that it ran
+// into if it is an ErrorMatcher
+func runMatcher(m Matcher, quit chan struct{}, q string, buffer []Line) ([]Line, error) {
+	if em, ok := m.(ErrorMatcher); ok {
+		return em.LineWithError(quit, q, buffer)
+	}
+	return m.Line(quit, q, buffer), nil
+}
+
+// NarrowingMatcher is implemented by matchers for which some changes
+// to the query can only ever match fewer lines, e.g. when "foo" becomes
+// "foob". Narrows returns true if `query` is such a change from `prev`,
+// in which case the results of `prev` may be searched instead of the
+// whole buffer
+type NarrowingMatcher interface {
+	Narrows(prev, query string) bool
+}
+
 // Matcher interface defines the API for things that want to
 // match against the buffer
 type Matcher interface {
@@ -95,6 +126,9 @@ const (
 	CaseSensitiveMatch = "CaseSensitive"
 	SmartCaseMatch     = "SmartCase"
 	RegexpMatch        = "Regexp"
+	FuzzyMatch         = "Fuzzy"
+	NormalizedMatch    = "Normalized"
+	ExtendedMatch      = "Extended"
 )
 
 var ignoreCaseFlags = []string{"i"}
@@ -120,6 +154,7 @@ type RegexpMatcher struct {
 	enableSep bool
 	flags     regexpFlags
 	quotemeta bool
+	extended  bool
 }
 
 // CaseSensitiveMatcher extends the RegxpMatcher, but always
@@ -140,6 +175,23 @@ type SmartCaseMatcher struct {
 	*RegexpMatcher
 }
 
+// ExtendedMatcher extends the RegexpMatcher, and matches each term
+// in the query literally, unless operators are used to anchor it or
+// to match a regular expression (see parseExtendedQuery). Like
+// SmartCaseMatcher, it ignores case unless the query contains an
+// upper-case character
+type ExtendedMatcher struct {
+	*RegexpMatcher
+}
+
+// FuzzyMatcher matches lines that contain all of the characters in
+// each of the query terms in the same order, but not necessarily
+// next to each other. Like SmartCaseMatcher, it ignores case unless
+// the query contains an upper-case character
+type FuzzyMatcher struct {
+	enableSep bool
+}
+
 // CustomMatcher spawns a new process to filter the buffer
 // in peco, and uses the output in its Stdout to figure
 // out what to display
@@ -147,6 +199,29 @@ type CustomMatcher struct {
 	enableSep bool
 	name      string
 	args      []string
+	server    *customMatcherServer
+	format    string
+}
+
+// These are the formats that a CustomMatcher may print its results in
+const (
+	// CustomMatcherFormatLines is the default. The process prints
+	// the matched lines as is
+	CustomMatcherFormatLines = "lines"
+	// CustomMatcherFormatJSON makes the process print a JSON object
+	// per matched line, with the line number (0 based) in the input,
+	// and optionally the byte ranges to highlight in the line:
+	// {"line":3,"indices":[[0,3],[5,7]]}
+	CustomMatcherFormatJSON = "json"
+)
+
+// customMatcherMatch is a matched line printed by a CustomMatcher
+// in CustomMatcherFormatJSON. The line may also be given by its ID
+// (see Line.ID), which a process in server mode is sent with each line
+type customMatcherMatch struct {
+	Line    int     `json:"line"`
+	LineID  uint64  `json:"line_id"`
+	Indices [][]int `json:"indices"`
 }
 
 // NewCaseSensitiveMatcher creates a new CaseSensitiveMatcher
@@ -170,6 +245,7 @@ func NewRegexpMatcher(enableSep bool) *RegexpMatcher {
 		enableSep,
 		regexpFlagList(defaultFlags),
 		false,
+		false,
 	}
 }
 
@@ -190,19 +266,56 @@ func containsUpper(query string) bool {
 // NewSmartCaseMatcher creates a new SmartCaseMatcher
 func NewSmartCaseMatcher(enableSep bool) *SmartCaseMatcher {
 	m := &SmartCaseMatcher{NewRegexpMatcher(enableSep)}
-	m.flags = regexpFlagFunc(func(q string) []string {
-		if containsUpper(q) {
-			return defaultFlags
-		}
-		return []string{"i"}
-	})
+	m.flags = regexpFlagFunc(smartCaseFlags)
 	m.quotemeta = true
 	return m
 }
 
+func smartCaseFlags(q string) []string {
+	if containsUpper(q) {
+		return defaultFlags
+	}
+	return ignoreCaseFlags
+}
+
+// NewExtendedMatcher creates a new ExtendedMatcher
+func NewExtendedMatcher(enableSep bool) *ExtendedMatcher {
+	m := &ExtendedMatcher{NewRegexpMatcher(enableSep)}
+	m.flags = regexpFlagFunc(smartCaseFlags)
+	m.extended = true
+	return m
+}
+
+// NewFuzzyMatcher creates a new FuzzyMatcher
+func NewFuzzyMatcher(enableSep bool) *FuzzyMatcher {
+	return &FuzzyMatcher{enableSep}
+}
+
+// Verify always returns nil
+func (m *FuzzyMatcher) Verify() error {
+	return nil
+}
+
 // NewCustomMatcher creates a new CustomMatcher
 func NewCustomMatcher(enableSep bool, name string, args []string) *CustomMatcher {
-	return &CustomMatcher{enableSep, name, args}
+	return &CustomMatcher{enableSep, name, args, nil, CustomMatcherFormatLines}
+}
+
+// SetFormat sets the format that the process prints its results in.
+// An empty string means CustomMatcherFormatLines
+func (m *CustomMatcher) SetFormat(format string) {
+	if format == "" {
+		format = CustomMatcherFormatLines
+	}
+	m.format = format
+}
+
+// EnableServer makes the matcher keep a single process running for
+// all queries, instead of spawning one for each query
+func (m *CustomMatcher) EnableServer() {
+	if len(m.args) > 0 {
+		m.server = newCustomMatcherServer(m.args)
+	}
 }
 
 // Verify checks to see that the executable given to CustomMatcher
@@ -215,9 +328,106 @@ func (m *CustomMatcher) Verify() error {
 	if _, err := exec.LookPath(m.args[0]); err != nil {
 		return err
 	}
+
+	switch m.format {
+	case CustomMatcherFormatLines, CustomMatcherFormatJSON:
+	default:
+		return fmt.Errorf("unknown format '%s' for custom matcher '%s'", m.format, m.name)
+	}
 	return nil
 }
 
+// lineFinder maps the lines output by a custom matcher in the plain
+// format back to the lines of the buffer, by their contents, so that
+// their Output() and ID are kept. Lines with the same contents are
+// found in the order of the buffer
+type lineFinder map[string][]Line
+
+func newLineFinder(buffer []Line) lineFinder {
+	f := make(lineFinder, len(buffer))
+	for _, l := range buffer {
+		s := l.DisplayString()
+		f[s] = append(f[s], l)
+	}
+	return f
+}
+
+// find returns the next line of the buffer that is displayed as s, or
+// nil if there is none left
+func (f lineFinder) find(s string) Line {
+	lines := f[s]
+	if len(lines) == 0 {
+		return nil
+	}
+	f[s] = lines[1:]
+	return lines[0]
+}
+
+// lineIndex finds the lines of the buffer that the matches reported
+// by a custom matcher refer to, either by their position in the buffer,
+// or by their IDs
+type lineIndex struct {
+	buffer []Line
+	ids    map[uint64]Line
+}
+
+func newLineIndex(buffer []Line) *lineIndex {
+	return &lineIndex{buffer, nil}
+}
+
+// find returns the line that `match` refers to, or nil if there is no
+// such line. The IDs are only indexed once they are used
+func (x *lineIndex) find(match customMatcherMatch) Line {
+	if match.LineID != 0 {
+		if x.ids == nil {
+			x.ids = make(map[uint64]Line, len(x.buffer))
+			for _, l := range x.buffer {
+				x.ids[l.ID()] = l
+			}
+		}
+		return x.ids[match.LineID]
+	}
+
+	if match.Line < 0 || match.Line >= len(x.buffer) {
+		return nil
+	}
+	return x.buffer[match.Line]
+}
+
+// matchedLine maps a match reported by the process back to the original
+// line in `lines`, so that its Output() is kept. Returns nil if there
+// is no such line. Highlights that don't fit in the line are dropped
+func (m *CustomMatcher) matchedLine(lines *lineIndex, match customMatcherMatch) Line {
+	l := lines.find(match)
+	if l == nil {
+		return nil
+	}
+
+	line := l.DisplayString()
+	indices := [][]int{}
+	for _, r := range match.Indices {
+		if len(r) != 2 || r[0] < 0 || r[0] >= r[1] || r[1] > len(line) {
+			continue
+		}
+		indices = append(indices, []int{r[0], r[1]})
+	}
+	sort.Sort(byStart(indices))
+
+	// Drop overlapping ranges, as they can't be drawn
+	valid := [][]int{}
+	for _, r := range indices {
+		if n := len(valid); n > 0 && r[0] < valid[n-1][1] {
+			continue
+		}
+		valid = append(valid, r)
+	}
+	if len(valid) == 0 {
+		valid = nil
+	}
+
+	return newMatchedLineFor(l, m.enableSep, valid)
+}
+
 func regexpFor(q string, flags []string, quotemeta bool) (*regexp.Regexp, error) {
 	reTxt := q
 	if quotemeta {
@@ -235,19 +445,50 @@ func regexpFor(q string, flags []string, quotemeta bool) (*regexp.Regexp, error)
 	return re, nil
 }
 
-func (m *RegexpMatcher) queryToRegexps(query string) ([]*regexp.Regexp, error) {
-	queries := strings.Split(strings.TrimSpace(query), " ")
-	regexps := make([]*regexp.Regexp, 0)
+// parseNegation checks if a query term is negated, i.e. lines that
+// match the term should be excluded. A term is negated when it starts
+// with a "!". Use "\!" to match a literal "!" at the beginning of a term
+func parseNegation(term string) (string, bool) {
+	switch {
+	case strings.HasPrefix(term, `\!`):
+		return term[1:], false
+	case len(term) > 1 && term[0] == '!':
+		return term[1:], true
+	}
+	return term, false
+}
 
-	for _, q := range queries {
-		re, err := regexpFor(q, m.flags.flags(query), m.quotemeta)
-		if err != nil {
-			return nil, err
+// parseQuery parses the query, and compiles each of the terms in it
+// according to the matcher's flags
+func (m *RegexpMatcher) parseQuery(query string) (queryNode, error) {
+	flags := m.flags.flags(query)
+	compile := func(literal, pattern string) (*regexp.Regexp, error) {
+		if m.quotemeta {
+			return regexpFor(literal, flags, true)
 		}
-		regexps = append(regexps, re)
+		return regexpFor(pattern, flags, false)
 	}
+	switch {
+	case m.extended:
+		return parseExtendedQuery(query, compile)
+	case !m.quotemeta:
+		return parseRegexpQuery(query, compile)
+	}
+	return parseQuery(query, compile)
+}
 
-	return regexps, nil
+// Narrows returns true if `query` only appends to `prev`. Appending
+// to a literal term or adding more terms narrows down the results,
+// but operators such as "|" and "!" may widen them, as may appending
+// to a regular expression (e.g. "fo" and "fo*")
+func (m *RegexpMatcher) Narrows(prev, query string) bool {
+	if m.extended {
+		return strings.HasPrefix(query, prev) && !strings.ContainsAny(query, `|()"!\'^$:`)
+	}
+	if !m.quotemeta {
+		return false
+	}
+	return strings.HasPrefix(query, prev) && !strings.ContainsAny(query, `|()"!\`)
 }
 
 func (m *RegexpMatcher) String() string {
@@ -266,6 +507,14 @@ func (m *SmartCaseMatcher) String() string {
 	return SmartCaseMatch
 }
 
+func (m *ExtendedMatcher) String() string {
+	return ExtendedMatch
+}
+
+func (m *FuzzyMatcher) String() string {
+	return FuzzyMatch
+}
+
 func (m *CustomMatcher) String() string {
 	return m.name
 }
@@ -290,65 +539,126 @@ func (m byStart) Less(i, j int) bool {
 // via `quit`. If anything is received via `quit`, the match
 // is halted.
 func (m *RegexpMatcher) Line(quit chan struct{}, q string, buffer []Line) []Line {
-	results := []Line{}
-	regexps, err := m.queryToRegexps(q)
+	results, err := m.LineWithError(quit, q, buffer)
 	if err != nil {
-		return results
+		return []Line{}
 	}
+	return results
+}
 
-	// The actual matching is done in a separate goroutine
-	iter := make(chan Line, len(buffer))
-	go func() {
-		// This protects us from panics, caused when we cancel the
-		// query and forcefully close the channel (and thereby
-		// causing a "close of a closed channel"
-		defer func() { recover() }()
+// LineWithError is like Line, but returns the error if the query
+// could not be parsed. The error is a QueryError
+func (m *RegexpMatcher) LineWithError(quit chan struct{}, q string, buffer []Line) ([]Line, error) {
+	node, err := m.parseQuery(q)
+	if err != nil {
+		return nil, err
+	}
 
-		// This must be here to make sure the channel is properly
-		// closed in normal cases
-		defer close(iter)
+	return matchLines(quit, buffer, func(match Line) Line {
+		ms, ok := m.matchNode(node, match.DisplayString(), match.Source())
+		if !ok {
+			return nil
+		}
+		return newMatchedLineFor(match, m.enableSep, ms)
+	}), nil
+}
 
-		// Iterate through the lines, and do the match.
-		// Upon success, send it through the channel
-		for _, match := range buffer {
-			ms := m.MatchAllRegexps(regexps, match.DisplayString())
-			if ms == nil {
-				continue
-			}
+// matchNode matches the parsed query against line, and returns the
+// portions of the line to highlight
+func (m *RegexpMatcher) matchNode(node queryNode, line, source string) ([][]int, bool) {
+	regexps, ok := node.Match(line, source, nil)
+	if !ok {
+		return nil, false
+	}
+
+	ms := m.MatchAllRegexps(regexps, line)
+	if ms == nil {
+		return nil, false
+	}
 
-			iter <- NewMatchedLine(match.Buffer(), m.enableSep, ms)
+	// A query with only negated terms matches without
+	// anything to highlight
+	if len(ms) == 0 {
+		ms = nil
+	}
+	return ms, true
+}
+
+// These control how matchLines splits the buffer
+const (
+	minMatchChunkSize   = 1000 // don't bother spawning goroutines for less
+	cancelCheckInterval = 100  // check for cancel requests every this many lines
+)
+
+// matchLines calls `match` against each line in `buffer`, and returns
+// the non-nil values that it returned. The buffer is split into chunks
+// that are matched concurrently on all available CPUs, and the results
+// are merged back in the same order as the buffer.
+//
+// If anything is received via `quit` while matching, all goroutines
+// are told to stop and an empty result is returned right away
+func matchLines(quit chan struct{}, buffer []Line, match func(Line) Line) []Line {
+	chunkSize := (len(buffer) + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0)
+	if chunkSize < minMatchChunkSize {
+		chunkSize = minMatchChunkSize
+	}
+
+	// The slots are allocated up front, as growing the slice would move
+	// it while the goroutines write to it
+	done := make(chan struct{})
+	chunks := make([][]Line, (len(buffer)+chunkSize-1)/chunkSize)
+	wg := &sync.WaitGroup{}
+	for i := range chunks {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(buffer) {
+			end = len(buffer)
 		}
-		iter <- nil
-	}()
 
-MATCH:
-	for {
-		select {
-		case <-quit:
-			// If we recieved a cancel request, we immediately bail out.
-			// It's a little dirty, but we focefully terminate the other
-			// goroutine by closing the channel, and invoking a panic in the
-			// goroutine above
-
-			// There's a possibility that the match fails early and the
-			// cancel happens after iter has been closed. It's totally okay
-			// for us to try to close iter, but trying to detect if the
-			// channel can be closed safely synchronously is really hard
-			// so we punt it by letting the close() happen at a separate
-			// goroutine, protected by a defer recover()
-			go func() {
-				defer func() { recover() }()
-				close(iter)
-			}()
-			break MATCH
-		case match := <-iter:
-			// Receive elements from the goroutine performing the match
-			if match == nil {
-				break MATCH
+		wg.Add(1)
+		go func(i int, lines []Line) {
+			defer wg.Done()
+
+			results := []Line{}
+			for n, l := range lines {
+				if n%cancelCheckInterval == 0 {
+					select {
+					case <-done:
+						return
+					default:
+					}
+				}
+
+				if r := match(l); r != nil {
+					results = append(results, r)
+				}
 			}
+			// Each goroutine only writes to its own slot, and we don't
+			// read from chunks until all of them are done
+			chunks[i] = results
+		}(i, buffer[start:end])
+	}
 
-			results = append(results, match)
-		}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-quit:
+		close(done)
+		return []Line{}
+	case <-finished:
+	}
+
+	total := 0
+	for _, c := range chunks {
+		total += len(c)
+	}
+	results := make([]Line, 0, total)
+	for _, c := range chunks {
+		results = append(results, c...)
 	}
 	return results
 }
@@ -390,26 +700,171 @@ Line:
 	return matches
 }
 
+// Line matches `q` against `buffer`. Each space separated term in `q`
+// must be found as a subsequence of the line, except for terms that
+// start with a "!", which must NOT be found in the line
+func (m *FuzzyMatcher) Line(quit chan struct{}, q string, buffer []Line) []Line {
+	results := []Line{}
+	terms := []string{}
+	negated := []string{}
+	for _, term := range strings.Fields(q) {
+		if term, negate := parseNegation(term); negate {
+			negated = append(negated, term)
+		} else {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 && len(negated) == 0 {
+		return results
+	}
+	ignoreCase := !containsUpper(q)
+
+	return matchLines(quit, buffer, func(match Line) Line {
+		line := match.DisplayString()
+		ms := m.MatchAllTerms(terms, line, ignoreCase)
+		if ms == nil {
+			return nil
+		}
+
+		for _, term := range negated {
+			if fuzzyMatchTerm(term, line, ignoreCase, map[int]int{}) {
+				return nil
+			}
+		}
+
+		if len(ms) == 0 {
+			ms = nil
+		}
+		return newMatchedLineFor(match, m.enableSep, ms)
+	})
+}
+
+// Narrows returns true if `query` only appends to `prev` without any
+// negated terms, as a longer subsequence can only match fewer lines
+func (m *FuzzyMatcher) Narrows(prev, query string) bool {
+	return strings.HasPrefix(query, prev) && !strings.ContainsAny(query, `!\`)
+}
+
+// MatchAllTerms fuzzy matches all of `terms` against line, and returns
+// the byte ranges of the matched characters, sorted and merged so that
+// adjacent characters form a single range. Returns nil if any of the
+// terms could not be matched
+func (m *FuzzyMatcher) MatchAllTerms(terms []string, line string, ignoreCase bool) [][]int {
+	matched := map[int]int{} // start offset -> end offset of each matched rune
+	for _, term := range terms {
+		if !fuzzyMatchTerm(term, line, ignoreCase, matched) {
+			return nil
+		}
+	}
+
+	starts := make([]int, 0, len(matched))
+	for start := range matched {
+		starts = append(starts, start)
+	}
+	sort.Ints(starts)
+
+	matches := [][]int{}
+	for _, start := range starts {
+		end := matched[start]
+		if l := len(matches); l > 0 && matches[l-1][1] == start {
+			matches[l-1][1] = end
+			continue
+		}
+		matches = append(matches, []int{start, end})
+	}
+	return matches
+}
+
+func fuzzyRuneEqual(a, b rune, ignoreCase bool) bool {
+	if ignoreCase {
+		return unicode.ToLower(a) == unicode.ToLower(b)
+	}
+	return a == b
+}
+
+// fuzzyMatchTerm looks for the characters in `term` in `line`, and
+// records the location of each matched character in `matched`.
+// Instead of simply picking the leftmost characters, it first finds
+// where the earliest match ends, and then scans backwards from there
+// so that the characters are as close to each other as possible:
+// "pcmg" against "peco/cmd/main.go" prefers "cmd/main.go" over
+// picking up the "c" in "peco"
+func fuzzyMatchTerm(term, line string, ignoreCase bool, matched map[int]int) bool {
+	pattern := []rune(term)
+	if len(pattern) == 0 {
+		return true
+	}
+
+	type position struct {
+		start int
+		end   int
+	}
+	runes := make([]position, 0, len(line))
+	chars := make([]rune, 0, len(line))
+	for i, r := range line {
+		runes = append(runes, position{i, i + utf8.RuneLen(r)})
+		chars = append(chars, r)
+	}
+
+	// Forward: find the earliest position where the whole term matched
+	pi := 0
+	last := -1
+	for i, r := range chars {
+		if fuzzyRuneEqual(r, pattern[pi], ignoreCase) {
+			pi++
+			if pi == len(pattern) {
+				last = i
+				break
+			}
+		}
+	}
+	if last < 0 {
+		return false
+	}
+
+	// Backward: from the end of the match, find the closest characters
+	pi = len(pattern) - 1
+	for i := last; i >= 0 && pi >= 0; i-- {
+		if fuzzyRuneEqual(chars[i], pattern[pi], ignoreCase) {
+			matched[runes[i].start] = runes[i].end
+			pi--
+		}
+	}
+	return true
+}
+
 // Match matches `q` aginst `buffer`
 func (m *CustomMatcher) Line(quit chan struct{}, q string, buffer []Line) []Line {
-	if len(m.args) < 1 {
+	results, err := m.LineWithError(quit, q, buffer)
+	if err != nil {
 		return []Line{}
 	}
+	return results
+}
+
+// LineWithError is like Line, but returns the error if the process
+// could not be run, or if it failed with a message in its Stderr
+func (m *CustomMatcher) LineWithError(quit chan struct{}, q string, buffer []Line) ([]Line, error) {
+	if len(m.args) < 1 {
+		return []Line{}, nil
+	}
 
 	results := []Line{}
 	if q == "" {
 		for _, match := range buffer {
-			results = append(results, NewMatchedLine(match.Buffer(), m.enableSep, nil))
+			results = append(results, newMatchedLineFor(match, m.enableSep, nil))
 		}
-		return results
+		return results, nil
 	}
 
-	// Receive elements from the goroutine performing the match
-	lines := []Line{}
-	matcherInput := ""
+	if m.server != nil {
+		return m.server.Line(m, quit, q, buffer)
+	}
+
+	matcherInput := &bytes.Buffer{}
 	for _, match := range buffer {
-		matcherInput += match.DisplayString() + "\n"
-		lines = append(lines, match)
+		matcherInput.WriteString(match.DisplayString())
+		matcherInput.WriteByte('\n')
 	}
 	args := []string{}
 	for _, arg := range m.args {
@@ -419,9 +874,13 @@ func (m *CustomMatcher) Line(quit chan struct{}, q string, buffer []Line) []Line
 		args = append(args, arg)
 	}
 	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdin = strings.NewReader(matcherInput)
+	cmd.Stdin = matcherInput
 
-	// See RegexpMatcher.Match() for explanation of constructs
+	// The process is run in a separate goroutine. If we receive a cancel
+	// request, we bail out by forcefully closing the channel, which
+	// causes a panic in the goroutine (protected by recover()) when it
+	// tries to send more results.
+	var runErr error // only read once nil has been received
 	iter := make(chan Line, len(buffer))
 	go func() {
 		defer func() { recover() }()
@@ -433,11 +892,39 @@ func (m *CustomMatcher) Line(quit chan struct{}, q string, buffer []Line) []Line
 		}()
 		b, err := cmd.Output()
 		if err != nil {
-			iter <- nil
+			if runErr = m.runError(err); runErr != nil {
+				iter <- nil
+				return
+			}
+		}
+		var finder lineFinder
+		var index *lineIndex
+		if m.format != CustomMatcherFormatJSON {
+			finder = newLineFinder(buffer)
+		} else {
+			index = newLineIndex(buffer)
 		}
 		for _, line := range strings.Split(string(b), "\n") {
-			if len(line) > 0 {
-				iter <- NewMatchedLine(line, m.enableSep, nil)
+			if len(line) == 0 {
+				continue
+			}
+
+			if m.format != CustomMatcherFormatJSON {
+				// Lines that the process made up are kept as they are
+				if l := finder.find(line); l != nil {
+					iter <- newMatchedLineFor(l, m.enableSep, nil)
+				} else {
+					iter <- NewMatchedLine(line, m.enableSep, nil)
+				}
+				continue
+			}
+
+			match := customMatcherMatch{}
+			if err := json.Unmarshal([]byte(line), &match); err != nil {
+				continue
+			}
+			if l := m.matchedLine(index, match); l != nil {
+				iter <- l
 			}
 		}
 		iter <- nil
@@ -453,11 +940,38 @@ MATCH:
 			break MATCH
 		case match := <-iter:
 			if match == nil {
+				if runErr != nil {
+					return nil, runErr
+				}
 				break MATCH
 			}
 			results = append(results, match)
 		}
 	}
 
-	return results
+	return results, nil
+}
+
+// runError decides whether an error from running the process should be
+// reported. Programs such as grep exit with a non-zero status when
+// nothing matched, so that alone is not treated as an error
+func (m *CustomMatcher) runError(err error) error {
+	return processError(m.name, err)
+}
+
+// processError turns an error from running a process into an error
+// that can be displayed in the status bar, prefixed by name. A non-zero
+// exit status without any message in Stderr is not an error
+func processError(name string, err error) error {
+	if ee, ok := err.(*exec.ExitError); ok {
+		msg := strings.TrimSpace(string(ee.Stderr))
+		if msg == "" {
+			return nil
+		}
+		if i := strings.IndexByte(msg, '\n'); i > -1 {
+			msg = msg[:i]
+		}
+		return fmt.Errorf("%s: %s", name, msg)
+	}
+	return fmt.Errorf("%s: %s", name, err)
 }
@@ -1,6 +1,9 @@
 package peco
 
 import (
+	"fmt"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -68,3 +71,195 @@ func TestNewMatch(t *testing.T) {
 	nullsepCheck(makeDidMatch("Hello, World!"))
 	nullsepCheck(makeDidMatch("Hello, World!\000Hello, peco!"))
 }
+
+func TestFuzzyMatcher(t *testing.T) {
+	m := NewFuzzyMatcher(false)
+	buffer := []Line{
+		NewRawLine("peco/cmd/main.go", false),
+		NewRawLine("peco/matchers.go", false),
+		NewRawLine("Changes", false),
+	}
+
+	results := m.Line(make(chan struct{}), "pcmg", buffer)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	// "p", "c", "m" and "g" should be picked as close to each other
+	// as possible
+	expected := [][]int{{0, 1}, {5, 6}, {9, 10}, {14, 15}}
+	if !reflect.DeepEqual(results[0].Indices(), expected) {
+		t.Errorf("Expected indices %v, got %v", expected, results[0].Indices())
+	}
+
+	// All terms must match
+	results = m.Line(make(chan struct{}), "mat go", buffer)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	expected = [][]int{{5, 8}, {14, 16}}
+	if !reflect.DeepEqual(results[0].Indices(), expected) {
+		t.Errorf("Expected indices %v, got %v", expected, results[0].Indices())
+	}
+
+	// Upper case characters in the query turn on case sensitive matching
+	if results = m.Line(make(chan struct{}), "CHG", buffer); len(results) != 0 {
+		t.Errorf("Expected no results, got %d", len(results))
+	}
+	if results = m.Line(make(chan struct{}), "Chg", buffer); len(results) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(results))
+	}
+}
+
+func TestNegatedQuery(t *testing.T) {
+	buffer := []Line{
+		NewRawLine("root 100 java -jar app.jar", false),
+		NewRawLine("root 200 java -jar jenkins.war", false),
+		NewRawLine("root 300 grep java", false),
+		NewRawLine("root 400 echo !important", false),
+	}
+
+	matchers := []Matcher{
+		NewIgnoreCaseMatcher(false),
+		NewCaseSensitiveMatcher(false),
+		NewSmartCaseMatcher(false),
+		NewRegexpMatcher(false),
+		NewFuzzyMatcher(false),
+	}
+	for _, m := range matchers {
+		results := m.Line(make(chan struct{}), "java !grep !jenkins", buffer)
+		if len(results) != 1 || results[0].DisplayString() != buffer[0].DisplayString() {
+			t.Errorf("%s: Expected only '%s' to match, got %v", m, buffer[0].DisplayString(), results)
+		}
+
+		results = m.Line(make(chan struct{}), "!java", buffer)
+		if len(results) != 1 || results[0].DisplayString() != buffer[3].DisplayString() {
+			t.Errorf("%s: Expected only '%s' to match, got %v", m, buffer[3].DisplayString(), results)
+			continue
+		}
+		if results[0].Indices() != nil {
+			t.Errorf("%s: Expected no indices, got %v", m, results[0].Indices())
+		}
+
+		results = m.Line(make(chan struct{}), `\!important`, buffer)
+		if len(results) != 1 || results[0].DisplayString() != buffer[3].DisplayString() {
+			t.Errorf("%s: Expected only '%s' to match, got %v", m, buffer[3].DisplayString(), results)
+		}
+	}
+}
+
+func TestMatchLinesParallel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	buffer := make([]Line, 10*minMatchChunkSize+1)
+	for i := range buffer {
+		buffer[i] = NewRawLine(fmt.Sprintf("line %d", i), false)
+	}
+
+	results := NewIgnoreCaseMatcher(false).Line(make(chan struct{}), "7", buffer)
+	expected := []string{}
+	for _, l := range buffer {
+		if strings.Contains(l.DisplayString(), "7") {
+			expected = append(expected, l.DisplayString())
+		}
+	}
+
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d", len(expected), len(results))
+	}
+	for i, l := range results {
+		if l.DisplayString() != expected[i] {
+			t.Errorf("Result %d should be '%s', got '%s'", i, expected[i], l.DisplayString())
+			break
+		}
+	}
+
+	quit := make(chan struct{}, 1)
+	quit <- struct{}{}
+	if results := NewIgnoreCaseMatcher(false).Line(quit, "line", buffer); len(results) != 0 {
+		t.Errorf("Expected cancelled query to return no results, got %d", len(results))
+	}
+}
+
+func TestCustomMatcherJSONFormat(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	// The process reports line numbers and ranges, some of which are
+	// out of bounds or overlapping and must be ignored
+	output := `{"line":2,"indices":[[4,7],[0,3],[1,2],[5,99]]}
+{"line":0}
+{"line":9}
+not json
+`
+	m := NewCustomMatcher(true, "JSON", []string{"sh", "-c", "cat >/dev/null; printf '%s' '" + output + "'"})
+	m.SetFormat(CustomMatcherFormatJSON)
+	if err := m.Verify(); err != nil {
+		t.Fatalf("Verify failed: %s", err)
+	}
+
+	buffer := []Line{
+		NewRawLine("foo\x00first", true),
+		NewRawLine("bar\x00second", true),
+		NewRawLine("baz qux\x00third", true),
+	}
+	results := m.Line(make(chan struct{}), "q", buffer)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	if o := results[0].Output(); o != "third" {
+		t.Errorf("Expected output 'third', got '%s'", o)
+	}
+	if idx := results[0].Indices(); !reflect.DeepEqual(idx, [][]int{{0, 3}, {4, 7}}) {
+		t.Errorf("Expected indices [[0 3] [4 7]], got %v", idx)
+	}
+	if o := results[1].Output(); o != "first" {
+		t.Errorf("Expected output 'first', got '%s'", o)
+	}
+	if idx := results[1].Indices(); idx != nil {
+		t.Errorf("Expected no indices, got %v", idx)
+	}
+
+	m.SetFormat("xml")
+	if err := m.Verify(); err == nil {
+		t.Errorf("Expected Verify to fail for an unknown format")
+	}
+}
+
+func TestCustomMatcherKeepsLines(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	// The plain format only has the displayed lines to go by, so that
+	// lines with the same contents are mapped back in order
+	m := NewCustomMatcher(true, "Plain", []string{"sh", "-c", "cat >/dev/null; printf 'foo\\nmade up\\nfoo\\n'"})
+	buffer := []Line{
+		NewRawLine("foo\x00first", true),
+		NewRawLine("bar\x00second", true),
+		NewRawLine("foo\x00third", true),
+	}
+	results := m.Line(make(chan struct{}), "q", buffer)
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	expected := []struct {
+		output string
+		id     uint64
+	}{
+		{"first", buffer[0].ID()},
+		{"made up", 0},
+		{"third", buffer[2].ID()},
+	}
+	for i, e := range expected {
+		if o := results[i].Output(); o != e.output {
+			t.Errorf("Result %d: expected output '%s', got '%s'", i, e.output, o)
+		}
+		if e.id != 0 && results[i].ID() != e.id {
+			t.Errorf("Result %d: expected the ID of the line in the buffer (%d), got %d", i, e.id, results[i].ID())
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package peco
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizedMatcher is like IgnoreCaseMatcher, but it matches against
+// a normalized form of the query and the lines, so that equivalent
+// characters match each other: accents are ignored (e.g. "cafe"
+// matches "Café"), as is the width of characters (e.g. half-width
+// katakana match full-width katakana, and full-width latin letters
+// match ASCII). The query and the lines are compared in their NFKD
+// forms, with the diacritics removed
+type NormalizedMatcher struct {
+	*RegexpMatcher
+}
+
+// NewNormalizedMatcher creates a new NormalizedMatcher
+func NewNormalizedMatcher(enableSep bool) *NormalizedMatcher {
+	m := &NormalizedMatcher{NewRegexpMatcher(enableSep)}
+	m.flags = regexpFlagList(ignoreCaseFlags)
+	m.quotemeta = true
+	return m
+}
+
+func (m *NormalizedMatcher) String() string {
+	return NormalizedMatch
+}
+
+// Narrows returns true if the normalized `query` only appends to the
+// normalized `prev`. Appending a voiced sound mark changes the previous
+// character, so it does not narrow the results
+func (m *NormalizedMatcher) Narrows(prev, query string) bool {
+	return m.RegexpMatcher.Narrows(normalizeString(prev), normalizeString(query))
+}
+
+// Line matches the normalized query against the normalized form of
+// each line, and maps the matched portions back to the original line
+func (m *NormalizedMatcher) Line(quit chan struct{}, q string, buffer []Line) []Line {
+	results, err := m.LineWithError(quit, q, buffer)
+	if err != nil {
+		return []Line{}
+	}
+	return results
+}
+
+// LineWithError is like Line, but returns the error if the query
+// could not be parsed
+func (m *NormalizedMatcher) LineWithError(quit chan struct{}, q string, buffer []Line) ([]Line, error) {
+	node, err := m.parseQuery(normalizeString(q))
+	if err != nil {
+		return nil, err
+	}
+
+	return matchLines(quit, buffer, func(match Line) Line {
+		n := normalize(match.DisplayString())
+		ms, ok := m.matchNode(node, n.text, match.Source())
+		if !ok {
+			return nil
+		}
+		return newMatchedLineFor(match, m.enableSep, n.mapIndices(ms))
+	}), nil
+}
+
+// normalizedText is a string in its normalized form, along with the
+// information needed to map offsets in it back to the original string
+type normalizedText struct {
+	text string
+	// For each byte in text, the range of bytes in the original
+	// string that produced it
+	starts []int
+	ends   []int
+}
+
+// These are the sound marks that combine with the previous kana. In
+// the NFKD form, their half-width forms become these too
+const (
+	voicedSoundMark     = '\u3099'
+	semiVoicedSoundMark = '\u309A'
+)
+
+// normalize returns the normalized form of s: its NFKD form, without
+// the nonspacing marks (Mn), which only add accents to the previous
+// character. The voiced sound marks are kept, and combined with the
+// previous kana again, so that e.g. "ガ" does not match "カ"
+func normalize(s string) normalizedText {
+	buf := make([]byte, 0, len(s))
+	starts := make([]int, 0, len(s))
+	ends := make([]int, 0, len(s))
+
+	last := -1 // where the last character starts in buf
+	for i, r := range s {
+		end := i + utf8.RuneLen(r)
+
+		decomposed := []byte(s[i:end])
+		if r >= utf8.RuneSelf {
+			if d := norm.NFKD.PropertiesString(s[i:]).Decomposition(); d != nil {
+				decomposed = d
+			}
+		}
+
+		for len(decomposed) > 0 {
+			c, size := utf8.DecodeRune(decomposed)
+			decomposed = decomposed[size:]
+
+			switch {
+			case c == voicedSoundMark || c == semiVoicedSoundMark:
+				if last < 0 {
+					break
+				}
+				prev, _ := utf8.DecodeRune(buf[last:])
+				composed := norm.NFC.String(string(prev) + string(c))
+				if utf8.RuneCountInString(composed) != 1 {
+					break
+				}
+				// Replace the previous character with the composed one
+				start := starts[last]
+				buf = append(buf[:last], composed...)
+				starts = starts[:last]
+				ends = ends[:last]
+				for len(starts) < len(buf) {
+					starts = append(starts, start)
+					ends = append(ends, end)
+				}
+				continue
+			case unicode.Is(unicode.Mn, c):
+				// Drop the mark, but make the previous character
+				// cover it in the original string
+				if last > -1 {
+					for j := last; j < len(buf); j++ {
+						ends[j] = end
+					}
+				}
+				continue
+			}
+
+			last = len(buf)
+			buf = append(buf, string(c)...)
+			for len(starts) < len(buf) {
+				starts = append(starts, i)
+				ends = append(ends, end)
+			}
+		}
+	}
+	return normalizedText{string(buf), starts, ends}
+}
+
+func normalizeString(s string) string {
+	return normalize(s).text
+}
+
+// mapIndices translates indices into the normalized text into indices
+// into the original string. Ranges that end up touching each other,
+// e.g. because they matched parts of the same ligature, are merged
+func (n normalizedText) mapIndices(matches [][]int) [][]int {
+	if matches == nil {
+		return nil
+	}
+
+	mapped := make([][]int, 0, len(matches))
+	for _, m := range matches {
+		if m[0] >= m[1] {
+			continue
+		}
+		mapped = append(mapped, []int{n.starts[m[0]], n.ends[m[1]-1]})
+	}
+	sort.Sort(byStart(mapped))
+
+	merged := [][]int{}
+	for _, m := range mapped {
+		if l := len(merged); l > 0 && m[0] <= merged[l-1][1] {
+			if m[1] > merged[l-1][1] {
+				merged[l-1][1] = m[1]
+			}
+			continue
+		}
+		merged = append(merged, m)
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
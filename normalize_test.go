@@ -0,0 +1,111 @@
+package peco
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"Café":        "Cafe",
+		"Café":       "Cafe",
+		"ｶﾞｲﾄﾞ":       "ガイド",
+		"ガイド":        "ガイド",
+		"ＡＢＣ　１２３":     "ABC 123",
+		"ﬁle":         "file",
+		"Nguyễn Trãi": "Nguyen Trai",
+		"plain text":  "plain text",
+		"ﾞ":           "゙",
+		"①②":          "12",
+		"㍻":           "平成",
+		"Tiếng Việt":  "Tieng Viet",
+		"Ελληνικά":    "Ελληνικα",
+		"ΆΈΉΊΌΎΏ ΐ":   "ΑΕΗΙΟΥΩ ι",
+		"한국어":         "한국어",
+	}
+	for in, expected := range tests {
+		if got := normalizeString(in); got != expected {
+			t.Errorf("normalize(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestNormalizedMatcher(t *testing.T) {
+	m := NewNormalizedMatcher(false)
+	buffer := []Line{
+		NewRawLine("Café de Flore", false),
+		NewRawLine("Café Noir", false),
+		NewRawLine("ｶﾞｲﾄﾞﾌﾞｯｸ.pdf", false),
+		NewRawLine("ﬁle.txt", false),
+		NewRawLine("coffee", false),
+	}
+
+	check := func(q string, expected map[string][][]int) {
+		results := m.Line(make(chan struct{}), q, buffer)
+		if len(results) != len(expected) {
+			t.Errorf("Query '%s': expected %d results, got %d", q, len(expected), len(results))
+			return
+		}
+		for _, l := range results {
+			indices, ok := expected[l.DisplayString()]
+			if !ok {
+				t.Errorf("Query '%s': unexpected result '%s'", q, l.DisplayString())
+				continue
+			}
+			if !reflect.DeepEqual(l.Indices(), indices) {
+				t.Errorf("Query '%s': expected indices %v for '%s', got %v", q, indices, l.DisplayString(), l.Indices())
+			}
+		}
+	}
+
+	// Highlights cover the original bytes, including combining marks
+	check("cafe", map[string][][]int{
+		"Café de Flore": {{0, 5}},
+		"Café Noir":    {{0, 6}},
+	})
+	check("CAFÉ", map[string][][]int{
+		"Café de Flore": {{0, 5}},
+		"Café Noir":    {{0, 6}},
+	})
+	// "ガイド" is 3 runes in the query, but 5 half-width runes in the line
+	check("ガイド", map[string][][]int{
+		"ｶﾞｲﾄﾞﾌﾞｯｸ.pdf": {{0, 15}},
+	})
+	check("ｶﾞｲ", map[string][][]int{
+		"ｶﾞｲﾄﾞﾌﾞｯｸ.pdf": {{0, 9}},
+	})
+	// Matching part of a ligature highlights all of it
+	check("fi", map[string][][]int{
+		"ﬁle.txt": {{0, 3}},
+	})
+
+	// Compatibility characters match their decomposition
+	buffer = []Line{
+		NewRawLine("平成30年度", false),
+		NewRawLine("㍻30年度", false),
+		NewRawLine("Step ① done", false),
+		NewRawLine("Ἀθῆναι", false),
+	}
+	check("平成", map[string][][]int{
+		"平成30年度": {{0, 6}},
+		"㍻30年度":  {{0, 3}},
+	})
+	check("step 1", map[string][][]int{
+		"Step ① done": {{0, 4}, {5, 8}},
+	})
+	check("αθηναι", map[string][][]int{
+		"Ἀθῆναι": {{0, 14}},
+	})
+
+	// Errors are reported for the normalized query
+	if _, err := m.LineWithError(make(chan struct{}), "（ｃａｆｅ", nil); err == nil {
+		t.Errorf("Expected an error for an unclosed group")
+	}
+
+	if m.Narrows("カ", "ガ") {
+		t.Errorf("Adding a voiced sound mark should not narrow the results")
+	}
+	if !m.Narrows("caf", "café") {
+		t.Errorf("Expected 'café' to narrow down 'caf'")
+	}
+}
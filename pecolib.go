@@ -22,6 +22,11 @@ type PecoOptions struct {
 	OptInitialMatcher string `long:"initial-matcher" description:"specify the default matcher"`
 	OptPrompt         string `long:"prompt" description:"specify the prompt string"`
 	OptLayout         string `long:"layout" description:"layout to be used 'top-down' (default) or 'bottom-up'"`
+	OptDelimiter      string `long:"delimiter" description:"delimiter used to split lines into fields for --match-fields (default: whitespace)"`
+	OptMatchFields    string `long:"match-fields" description:"only match against these fields (e.g. '2..', '1,3')"`
+	OptHistoryKey     string `long:"history-key" description:"keep a separate query history under this name"`
+	OptContext        int    `long:"context" description:"show this many lines of input before and after each match"`
+	OptSelect1        bool   `long:"select-1" description:"if there is only one line (after --query), print it and exit without the user interface"`
 }
 
 func NewPecoOption() *PecoOptions {
@@ -57,12 +62,12 @@ func (i *ChoicesHelper) draw(choices []Line) {
 	m := &sync.Mutex{}
 	var refresh *time.Timer
 
-	i.lines = choices
+	i.SetLines(choices)
 	m.Lock()
 	if refresh == nil {
 		refresh = time.AfterFunc(100*time.Millisecond, func() {
 			if !i.ExecQuery() {
-				i.DrawMatches(i.lines)
+				i.DrawMatches(i.GetLines())
 			}
 			m.Lock()
 			refresh = nil
@@ -151,7 +156,9 @@ func pecolibWrap(choices []Choosable, opts *PecoOptions) ([]interface{}, error)
 		choiceMap[s] = c
 
 		// TODO investigate NewNoMatch boolean
-		matches = append(matches, NewRawLine(s, true))
+		l := NewRawLine(s, true)
+		l.index = len(matches)
+		matches = append(matches, l)
 	}
 
 	if len(matches) == 0 {
@@ -216,6 +223,31 @@ func pecolib(choices []Line, opts *PecoOptions) ([]Line, error) {
 		ctx.SetPrompt(opts.OptPrompt)
 	}
 
+	if opts.OptContext > 0 {
+		ctx.SetContextLines(opts.OptContext)
+	}
+
+	if err = ctx.SetMatchFields(opts.OptDelimiter, opts.OptMatchFields); err != nil {
+		return nil, err
+	}
+
+	if err = ctx.LoadHistory(opts.OptHistoryKey); err != nil {
+		return nil, err
+	}
+
+	if opts.OptSelect1 {
+		candidates := choices
+		if len(opts.OptQuery) > 0 {
+			candidates, err = ctx.MatchLines(opts.OptQuery, choices)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(candidates) == 1 {
+			return candidates, nil
+		}
+	}
+
 	choicesHelper := ChoicesHelper{ctx}
 	choicesHelper.draw(choices)
 	err = TtyReady()
@@ -0,0 +1,499 @@
+package peco
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"unicode"
+)
+
+// The regexp based matchers parse the query into a tree of
+// queryNodes before matching. The grammar is as follows:
+//
+//   query   := or
+//   or      := and ( "|" and )*
+//   and     := unary ( unary )*
+//   unary   := "!" unary | primary
+//   primary := "(" or ")" | phrase | word
+//
+// Terms that are next to each other must all match ("AND"). A phrase
+// is a quoted string that may contain spaces, such as "connection reset".
+// The operators are only recognized at the start of a term, so that
+// words such as main() or foo|bar.log are matched as they are. A word
+// ends at a space, or at a ")" that closes a group that was opened
+// before the word. Any of the special characters can be matched
+// literally by escaping them with a backslash, e.g. \( or \|
+//
+// With the Regexp matcher, each word is a regular expression, which
+// is not split by the grammar (see parseRegexpQuery)
+//
+// The extended syntax (see parseExtendedQuery) adds operators to words:
+//
+//   'word    matches word exactly
+//   ^word    matches lines that start with word
+//   word$    matches lines that end with word
+//   re:expr  matches the regular expression expr
+//   in:name  matches lines read from the input named name (see Line.Source)
+//
+// In the extended syntax ', ^ and $ may also be escaped
+
+// QueryError describes a problem found while parsing or compiling
+// the query. Pos is the position (in runes) in the query where the
+// problem was found
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+// Error fulfills the error interface
+func (e QueryError) Error() string {
+	return fmt.Sprintf("%s (at position %d)", e.Msg, e.Pos+1)
+}
+
+// queryNode is a node in the parsed query. Match returns true if
+// the line, read from the input named source, matched the node.
+// Regexps that matched the line and should be used for highlighting
+// are appended to `matched`
+type queryNode interface {
+	Match(line, source string, matched []*regexp.Regexp) ([]*regexp.Regexp, bool)
+}
+
+type queryTerm struct {
+	re *regexp.Regexp
+}
+
+func (t queryTerm) Match(line, source string, matched []*regexp.Regexp) ([]*regexp.Regexp, bool) {
+	if !t.re.MatchString(line) {
+		return matched, false
+	}
+	return append(matched, t.re), true
+}
+
+// querySource matches lines that were read from the named input,
+// either by its full name or by its base name
+type querySource struct {
+	name string
+}
+
+func (s querySource) Match(line, source string, matched []*regexp.Regexp) ([]*regexp.Regexp, bool) {
+	if source != s.name && filepath.Base(source) != s.name {
+		return nil, false
+	}
+	return matched, true
+}
+
+type queryAnd []queryNode
+
+func (a queryAnd) Match(line, source string, matched []*regexp.Regexp) ([]*regexp.Regexp, bool) {
+	for _, n := range a {
+		var ok bool
+		if matched, ok = n.Match(line, source, matched); !ok {
+			return nil, false
+		}
+	}
+	return matched, true
+}
+
+type queryOr []queryNode
+
+func (o queryOr) Match(line, source string, matched []*regexp.Regexp) ([]*regexp.Regexp, bool) {
+	// Don't stop at the first match: all of the alternatives that
+	// matched should be highlighted
+	found := false
+	for _, n := range o {
+		if m, ok := n.Match(line, source, nil); ok {
+			matched = append(matched, m...)
+			found = true
+		}
+	}
+	return matched, found
+}
+
+type queryNot struct {
+	node queryNode
+}
+
+func (n queryNot) Match(line, source string, matched []*regexp.Regexp) ([]*regexp.Regexp, bool) {
+	if _, ok := n.node.Match(line, source, nil); ok {
+		return nil, false
+	}
+	return matched, true
+}
+
+// queryCompiler is called with each term found in the query. `literal`
+// is the term with all escapes resolved, and `pattern` is a regular
+// expression where only the escaped characters have been quoted
+type queryCompiler func(literal, pattern string) (*regexp.Regexp, error)
+
+type queryParser struct {
+	query    []rune
+	pos      int
+	compile  queryCompiler
+	extended bool
+	// regexpTerms makes words regular expressions, in which "(" and
+	// ")" are not operators
+	regexpTerms bool
+	// depth is the number of groups that are open
+	depth int
+}
+
+func parseQuery(query string, compile queryCompiler) (queryNode, error) {
+	return (&queryParser{query: []rune(query), compile: compile}).parse()
+}
+
+// parseRegexpQuery parses the query for the Regexp matcher. Words are
+// passed to `compile` as they are, e.g. (a|b)c, so there are no groups.
+// Phrases, "|" between terms and "!" still work as with parseQuery
+func parseRegexpQuery(query string, compile queryCompiler) (queryNode, error) {
+	return (&queryParser{query: []rune(query), compile: compile, regexpTerms: true}).parse()
+}
+
+// parseExtendedQuery parses the query using the extended syntax. Each
+// term is passed to `compile` as a regular expression in `pattern`,
+// which already has the operators applied to it. Words and phrases
+// without operators are quoted, so that they are matched literally
+func parseExtendedQuery(query string, compile queryCompiler) (queryNode, error) {
+	return (&queryParser{query: []rune(query), compile: compile, extended: true}).parse()
+}
+
+func (p *queryParser) parse() (queryNode, error) {
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if !p.eof() {
+		return nil, QueryError{p.pos, fmt.Sprintf("unexpected '%c'", p.peek())}
+	}
+	return n, nil
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.query)
+}
+
+func (p *queryParser) peek() rune {
+	return p.query[p.pos]
+}
+
+func (p *queryParser) skipSpaces() {
+	for !p.eof() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	start := p.pos
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := queryOr{first}
+	for {
+		p.skipSpaces()
+		if p.eof() || p.peek() != '|' {
+			break
+		}
+		p.pos++
+
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if len(n.(queryAnd)) == 0 {
+			return nil, QueryError{p.pos, "expected a term after '|'"}
+		}
+		nodes = append(nodes, n)
+	}
+
+	if len(nodes) == 1 {
+		return first, nil
+	}
+	if len(first.(queryAnd)) == 0 {
+		return nil, QueryError{start, "expected a term before '|'"}
+	}
+	return nodes, nil
+}
+
+// parseAnd always returns a queryAnd, which may be empty if there
+// were no terms to be found
+func (p *queryParser) parseAnd() (queryNode, error) {
+	nodes := queryAnd{}
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			break
+		}
+		if c := p.peek(); c == '|' || (c == ')' && p.depth > 0) {
+			break
+		}
+
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.peek() == '!' && p.pos+1 < len(p.query) {
+		// A lone "!" is just a literal
+		switch c := p.query[p.pos+1]; {
+		case unicode.IsSpace(c), c == '|', c == ')':
+		default:
+			p.pos++
+			n, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return queryNot{n}, nil
+		}
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	switch p.peek() {
+	case '(':
+		if p.regexpTerms {
+			break
+		}
+		start := p.pos
+		p.pos++
+		p.depth++
+		n, err := p.parseOr()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.eof() {
+			return nil, QueryError{start, "missing closing ')'"}
+		}
+		p.pos++ // parseOr only stops at ')' or EOF
+		if a, ok := n.(queryAnd); ok && len(a) == 0 {
+			return nil, QueryError{start, "empty group"}
+		}
+		return n, nil
+	case '"':
+		return p.parsePhrase()
+	}
+	if p.extended && p.hasPrefix("re:") {
+		return p.parseRegexp()
+	}
+	if p.extended && p.hasPrefix("in:") {
+		return p.parseSource()
+	}
+	return p.parseWord()
+}
+
+func (p *queryParser) hasPrefix(s string) bool {
+	r := []rune(s)
+	return len(p.query)-p.pos >= len(r) && string(p.query[p.pos:p.pos+len(r)]) == s
+}
+
+func (p *queryParser) parsePhrase() (queryNode, error) {
+	start := p.pos
+	p.pos++ // opening quote
+
+	literal := []rune{}
+	pattern := []rune{}
+	for {
+		if p.eof() {
+			return nil, QueryError{start, "unterminated quote"}
+		}
+
+		c := p.peek()
+		p.pos++
+		if c == '"' {
+			break
+		}
+
+		if c == '\\' && !p.eof() {
+			switch n := p.peek(); n {
+			case '"':
+				literal = append(literal, n)
+				pattern = append(pattern, n)
+				p.pos++
+				continue
+			case '\\':
+				literal = append(literal, n)
+				pattern = append(pattern, c, n)
+				p.pos++
+				continue
+			}
+		}
+		literal = append(literal, c)
+		pattern = append(pattern, c)
+	}
+	if p.extended {
+		return p.term(start, string(literal), regexp.QuoteMeta(string(literal)))
+	}
+	return p.term(start, string(literal), string(pattern))
+}
+
+func (p *queryParser) isSpecial(c rune) bool {
+	switch c {
+	case '|', '(', ')', '"', '!', '\\':
+		return true
+	case '\'', '^', '$':
+		return p.extended
+	}
+	return unicode.IsSpace(c)
+}
+
+func (p *queryParser) parseWord() (queryNode, error) {
+	start := p.pos
+
+	// Operators at the start of the word in the extended syntax
+	exact, prefix := false, false
+	if p.extended {
+		switch p.peek() {
+		case '\'':
+			exact = true
+			p.pos++
+		case '^':
+			prefix = true
+			p.pos++
+		}
+	}
+
+	literal := []rune{}
+	pattern := []rune{}
+	suffix := false
+	depth := 0 // parentheses opened in the word, as in main()
+	for !p.eof() {
+		c := p.peek()
+		if p.endsWord(c, depth) {
+			break
+		}
+		p.pos++
+
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		}
+
+		if c == '\\' && !p.eof() && p.isSpecial(p.peek()) {
+			n := p.peek()
+			p.pos++
+			literal = append(literal, n)
+			pattern = append(pattern, []rune(regexp.QuoteMeta(string(n)))...)
+			continue
+		}
+
+		// An unescaped "$" at the end of the word
+		if p.extended && !exact && c == '$' && (p.eof() || p.endsWord(p.peek(), depth)) {
+			suffix = true
+			break
+		}
+		literal = append(literal, c)
+		pattern = append(pattern, c)
+	}
+
+	if !p.extended {
+		return p.term(start, string(literal), string(pattern))
+	}
+
+	if len(literal) == 0 {
+		return nil, QueryError{start, "expected a term after the operator"}
+	}
+	re := regexp.QuoteMeta(string(literal))
+	if prefix {
+		re = "^" + re
+	}
+	if suffix {
+		re = re + "$"
+	}
+	return p.term(start, string(literal), re)
+}
+
+// endsWord checks whether c ends the current word, in which depth
+// parentheses are open
+func (p *queryParser) endsWord(c rune, depth int) bool {
+	return unicode.IsSpace(c) || (c == ')' && depth == 0 && p.depth > 0 && !p.regexpTerms)
+}
+
+// parseRegexp parses a "re:" term in the extended syntax. The regular
+// expression extends to the next space, or to a ")" that closes a group
+// that was opened before the term
+func (p *queryParser) parseRegexp() (queryNode, error) {
+	start := p.pos
+	p.pos += len("re:")
+
+	pattern := []rune{}
+	depth := 0
+	for !p.eof() {
+		c := p.peek()
+		if p.endsWord(c, depth) {
+			break
+		}
+		p.pos++
+
+		switch c {
+		case '\\':
+			if !p.eof() {
+				pattern = append(pattern, c, p.peek())
+				p.pos++
+				continue
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		pattern = append(pattern, c)
+	}
+
+	if len(pattern) == 0 {
+		return nil, QueryError{start, "expected a regular expression after 're:'"}
+	}
+	return p.term(start, string(pattern), string(pattern))
+}
+
+// parseSource parses an "in:" term in the extended syntax. The name
+// extends to the next space, and may contain escaped spaces
+func (p *queryParser) parseSource() (queryNode, error) {
+	start := p.pos
+	p.pos += len("in:")
+
+	name := []rune{}
+	for !p.eof() {
+		c := p.peek()
+		if p.endsWord(c, 0) {
+			break
+		}
+		p.pos++
+
+		if c == '\\' && !p.eof() && p.isSpecial(p.peek()) {
+			c = p.peek()
+			p.pos++
+		}
+		name = append(name, c)
+	}
+
+	if len(name) == 0 {
+		return nil, QueryError{start, "expected the name of an input after 'in:'"}
+	}
+	return querySource{string(name)}, nil
+}
+
+func (p *queryParser) term(start int, literal, pattern string) (queryNode, error) {
+	re, err := p.compile(literal, pattern)
+	if err != nil {
+		// The regexp package includes the whole expression in the
+		// message, along with any flags that were added to it
+		if serr, ok := err.(*syntax.Error); ok {
+			return nil, QueryError{start, fmt.Sprintf("invalid regular expression: %s", serr.Code)}
+		}
+		return nil, QueryError{start, err.Error()}
+	}
+	return queryTerm{re}, nil
+}
@@ -0,0 +1,238 @@
+package peco
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryLanguage(t *testing.T) {
+	buffer := []Line{
+		NewRawLine("read: connection reset by peer", false),
+		NewRawLine("write: broken pipe", false),
+		NewRawLine("connection refused", false),
+		NewRawLine("f(x) | g(x)", false),
+		NewRawLine("func main() {", false),
+	}
+
+	tests := []struct {
+		query    string
+		expected []int
+	}{
+		{"connection", []int{0, 2}},
+		{`"connection reset"`, []int{0}},
+		{"reset | pipe", []int{0, 1}},
+		{"reset |pipe", []int{0, 1}},
+		{"connection (reset | refused)", []int{0, 2}},
+		{"(read | write) !pipe", []int{0}},
+		{"!(reset | refused)", []int{1, 3, 4}},
+		{`f\(x\) \|`, []int{3}},
+		{`"f(x) | g(x)"`, []int{3}},
+		// Operators in the middle of a word are matched literally
+		{"main()", []int{4}},
+		{"f(x)", []int{3}},
+		{"reset|pipe", []int{}},
+		{"x)", []int{3}},
+		{`main("`, []int{}},
+		{"(main() | f(x))", []int{3, 4}},
+	}
+
+	m := NewIgnoreCaseMatcher(false)
+	for _, test := range tests {
+		results := m.Line(make(chan struct{}), test.query, buffer)
+		got := []int{}
+		for _, l := range results {
+			for i, b := range buffer {
+				if b.Buffer() == l.Buffer() {
+					got = append(got, i)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Query '%s': expected lines %v, got %v", test.query, test.expected, got)
+		}
+	}
+
+	// All of the alternatives that matched should be highlighted
+	results := m.Line(make(chan struct{}), "read | reset", buffer)
+	expected := [][]int{{0, 4}, {17, 22}}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Indices(), expected) {
+		t.Errorf("Expected indices %v, got %v", expected, results)
+	}
+}
+
+func TestQueryLanguageRegexp(t *testing.T) {
+	buffer := []Line{
+		NewRawLine("GET /index.html 200 12ms", false),
+		NewRawLine("GET /login 500 1024ms", false),
+	}
+
+	m := NewRegexpMatcher(false)
+	results := m.Line(make(chan struct{}), `"\d{4}ms" | "\.html 2\d\d"`, buffer)
+	if len(results) != 2 {
+		t.Errorf("Expected 2 results, got %d", len(results))
+	}
+
+	// Words are regular expressions, which the grammar doesn't split
+	results = m.Line(make(chan struct{}), `(index|login)\. !(x|y)z`, buffer)
+	if len(results) != 1 || results[0].Buffer() != buffer[0].Buffer() {
+		t.Errorf("Expected only the first line to match, got %v", results)
+	}
+	results = m.Line(make(chan struct{}), `GET (/login|/admin)`, buffer)
+	if len(results) != 1 || results[0].Buffer() != buffer[1].Buffer() {
+		t.Errorf("Expected only the second line to match, got %v", results)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{"(foo", 0},
+		{"(foo | )", 7},
+		{`foo "bar`, 4},
+		{"foo |", 5},
+		{"| foo", 0},
+		{"foo ()", 4},
+	}
+
+	m := NewIgnoreCaseMatcher(false)
+	for _, test := range tests {
+		_, err := m.LineWithError(make(chan struct{}), test.query, nil)
+		if err == nil {
+			t.Errorf("Query '%s' should fail to parse", test.query)
+			continue
+		}
+		qerr, ok := err.(QueryError)
+		if !ok {
+			t.Errorf("Query '%s': expected QueryError, got %#v", test.query, err)
+			continue
+		}
+		if qerr.Pos != test.pos {
+			t.Errorf("Query '%s': expected error at %d, got %d (%s)", test.query, test.pos, qerr.Pos, qerr)
+		}
+	}
+
+	re := NewRegexpMatcher(false)
+	if _, err := re.LineWithError(make(chan struct{}), "foo (bar", nil); err == nil {
+		t.Errorf("Expected error for unclosed group in a regular expression")
+	}
+	if _, err := re.LineWithError(make(chan struct{}), `"foo("`, nil); err == nil {
+		t.Errorf("Expected error for invalid regular expression")
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	buffer := []Line{
+		NewRawLine("src/main.go", false),
+		NewRawLine("src/main.go.orig", false),
+		NewRawLine("test/main_test.go", false),
+		NewRawLine("README.md", false),
+		NewRawLine("^weird$name", false),
+	}
+
+	tests := []struct {
+		query    string
+		expected []int
+	}{
+		{"main.go", []int{0, 1}},
+		{".go$", []int{0, 2}},
+		{"^src main", []int{0, 1}},
+		{"^src !.orig", []int{0}},
+		{"!^src .go$", []int{2}},
+		{"'main.go", []int{0, 1}},
+		{`re:main(_test)?\.go$`, []int{0, 2}},
+		{`(re:^src | readme)`, []int{0, 1, 3}},
+		{`re:m.i.\.`, []int{0, 1}},
+		{`\^weird`, []int{4}},
+		{`'^weird`, []int{4}},
+		{`weird\$`, []int{4}},
+		{"readme", []int{3}},
+		{"README", []int{3}},
+		{"Readme", []int{}},
+	}
+
+	m := NewExtendedMatcher(false)
+	for _, test := range tests {
+		results := m.Line(make(chan struct{}), test.query, buffer)
+		got := []int{}
+		for _, l := range results {
+			for i, b := range buffer {
+				if b.Buffer() == l.Buffer() {
+					got = append(got, i)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Query '%s': expected lines %v, got %v", test.query, test.expected, got)
+		}
+	}
+
+	// Anchored terms only highlight the anchored match
+	results := m.Line(make(chan struct{}), "go$", buffer[:1])
+	expected := [][]int{{9, 11}}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Indices(), expected) {
+		t.Errorf("Expected indices %v, got %v", expected, results)
+	}
+
+	for _, q := range []string{"^", "foo '", "re:", "re:foo("} {
+		if _, err := m.LineWithError(make(chan struct{}), q, nil); err == nil {
+			t.Errorf("Query '%s' should fail to parse", q)
+		}
+	}
+
+	if !m.Narrows("mai", "main") {
+		t.Errorf("Expected 'main' to narrow down 'mai'")
+	}
+	for _, q := range []string{"main$", "re:main", "main|"} {
+		if m.Narrows("main", q) {
+			t.Errorf("Expected '%s' not to narrow down 'main'", q)
+		}
+	}
+}
+
+func TestSourceQuery(t *testing.T) {
+	buffer := []Line{}
+	for _, src := range []string{"logs/app.log", "logs/db.log", "-"} {
+		l := NewRawLine("error: "+src, false)
+		l.source = src
+		buffer = append(buffer, l)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"in:app.log", []string{"logs/app.log"}},
+		{"in:logs/db.log error", []string{"logs/db.log"}},
+		{"!in:- error", []string{"logs/app.log", "logs/db.log"}},
+		{"in:app.log | in:-", []string{"logs/app.log", "-"}},
+		{"in:logs", []string{}},
+	}
+
+	m := NewExtendedMatcher(false)
+	for _, test := range tests {
+		got := []string{}
+		for _, l := range m.Line(make(chan struct{}), test.query, buffer) {
+			got = append(got, l.Source())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Query '%s': expected sources %v, got %v", test.query, test.expected, got)
+		}
+	}
+
+	if _, err := m.LineWithError(make(chan struct{}), "in:", nil); err == nil {
+		t.Errorf("Query 'in:' should fail to parse")
+	}
+}
+
+func TestQueryErrorMessage(t *testing.T) {
+	_, err := NewRegexpMatcher(false).LineWithError(make(chan struct{}), `foo "bar("`, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for an incomplete regular expression")
+	}
+	expected := "invalid regular expression: missing closing ) (at position 5)"
+	if err.Error() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, err)
+	}
+}
@@ -2,9 +2,10 @@ package peco
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
-	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,10 +20,21 @@ type BufferReader struct {
 	*Ctx
 	input        io.ReadCloser
 	inputReadyCh chan struct{}
+	source       string
+	// replaced is the number of times the buffer had been replaced
+	// when the reader was created. Once the buffer is replaced again
+	// (e.g. by peco.Reload), the lines no longer belong in it
+	replaced uint64
+}
+
+// SetSource sets the name of the input, which is remembered by each
+// of the lines that are read (see Line.Source)
+func (b *BufferReader) SetSource(name string) {
+	b.source = name
 }
 
 // InputReadyCh returns a channel which, when the input starts coming
-// in, sends a struct{}{}
+// in, sends a struct{}{}. The channel is closed when the input ends
 func (b *BufferReader) InputReadyCh() <-chan struct{} {
 	return b.inputReadyCh
 }
@@ -35,14 +47,30 @@ func (b *BufferReader) Loop() {
 
 	ch := make(chan string, 10)
 
-	// scanner.Scan() blocks until the next read or error. But we want to
+	// ReadLine() blocks until the next read or error. But we want to
 	// exit immediately, so we move it out to its own goroutine
 	go func() {
 		defer func() { recover() }()
 		defer func() { close(ch) }()
-		scanner := bufio.NewScanner(b.input)
-		for scanner.Scan() {
-			ch <- scanner.Text()
+		input, enc, err := decodeInput(b.input, b.InputEncoding())
+		if err != nil {
+			return
+		}
+		b.setSourceEncoding(b.source, enc)
+		reader := newLineReader(input, b.InputDelimiter())
+		warned := false
+		for {
+			line, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+			if len(line) > hugeLineSize && !warned {
+				// In a goroutine, as the view may not be there yet
+				// to receive the message
+				warned = true
+				go b.SendStatusMsg(fmt.Sprintf("Warning: read a line of %d bytes, matching may be slow", len(line)))
+			}
+			ch <- line
 		}
 	}()
 
@@ -50,6 +78,14 @@ func (b *BufferReader) Loop() {
 	once := &sync.Once{}
 	var refresh *time.Timer
 
+	// The position of the next line in the input, counting the empty
+	// lines that are skipped (see Line.Index)
+	index := 0
+
+	// Empty lines are skipped, but with a delimiter, empty records
+	// are kept, as they may stand for empty fields or names
+	keepEmpty := b.InputDelimiter() != ""
+
 	loop := true
 	for loop {
 		select {
@@ -61,19 +97,19 @@ func (b *BufferReader) Loop() {
 				continue
 			}
 
-			if line != "" {
+			if line != "" || keepEmpty {
 				// Notify once that we have received something from the file/stdin
 				once.Do(func() { b.inputReadyCh <- struct{}{} })
 
-				// Make sure we lock access to b.lines
-				m.Lock()
-				b.SetLines(append(b.GetLines(), NewRawLine(line, b.enableSep)))
-				if b.IsBufferOverflowing() {
-					lines := b.GetLines()
-					b.SetLines(lines[1:])
+				l := NewRawLine(line, b.enableSep)
+				l.source = b.source
+				l.index = index
+				if !b.appendLineSince(l, b.replaced) {
+					loop = false
+					continue
 				}
-				m.Unlock()
 			}
+			index++
 
 			m.Lock()
 			if refresh == nil {
@@ -91,11 +127,144 @@ func (b *BufferReader) Loop() {
 	}
 
 	b.input.Close()
+}
+
+// hugeLineSize is the length of a line above which we warn the user,
+// as matching against such lines may be slow
+const hugeLineSize = 1 << 20
+
+// lineReader reads lines of any length, unlike bufio.Scanner, which
+// gives up on lines that are longer than its buffer. Lines are split at
+// each delimiter (--input-delimiter), or at newlines (with an optional
+// carriage return) if the delimiter is empty
+type lineReader struct {
+	reader    *bufio.Reader
+	delimiter string
+}
+
+func newLineReader(r io.Reader, delimiter string) *lineReader {
+	return &lineReader{bufio.NewReader(r), delimiter}
+}
+
+// ReadLine returns the next line, without its delimiter. It returns
+// io.EOF after the last line
+func (r *lineReader) ReadLine() (string, error) {
+	last := byte('\n')
+	if r.delimiter != "" {
+		last = r.delimiter[len(r.delimiter)-1]
+	}
+
+	// The line is built in a strings.Builder, so that it is not copied
+	// again when it is converted to a string. Lines that fit in the
+	// bufio.Reader's buffer are written to it at once, and longer lines
+	// are written as they come in, except for the last few bytes, which
+	// may turn out to be part of the delimiter (or a carriage return)
+	var b strings.Builder
+	var tail []byte
+	for {
+		// The slice is only valid until the next read
+		chunk, err := r.reader.ReadSlice(last)
+		switch {
+		case err == bufio.ErrBufferFull:
+			if b.Len() == 0 {
+				// Make room for more than the buffer right away, as
+				// the line is longer than that
+				b.Grow(2 * len(chunk))
+			}
+			tail = r.write(&b, tail, chunk, r.keep())
+			continue
+		case err != nil:
+			if b.Len() == 0 && len(tail) == 0 && len(chunk) == 0 {
+				return "", err
+			}
+			// The last line doesn't have to end with a delimiter
+			n := 0
+			if r.delimiter == "" && bytes.HasSuffix(r.suffix(tail, chunk, 1), []byte("\r")) {
+				n = 1
+			}
+			r.write(&b, tail, chunk, n)
+			return b.String(), nil
+		case r.delimiter == "":
+			n := 1
+			if bytes.Equal(r.suffix(tail, chunk, 2), []byte("\r\n")) {
+				n = 2
+			}
+			r.write(&b, tail, chunk, n)
+			return b.String(), nil
+		case bytes.Equal(r.suffix(tail, chunk, len(r.delimiter)), []byte(r.delimiter)):
+			r.write(&b, tail, chunk, len(r.delimiter))
+			return b.String(), nil
+		default:
+			// The last byte of the delimiter, but not the rest of it
+			tail = r.write(&b, tail, chunk, r.keep())
+		}
+	}
+}
+
+// keep returns the number of bytes at the end of an unfinished line
+// that may be the start of the delimiter
+func (r *lineReader) keep() int {
+	if r.delimiter == "" {
+		return 1 // a carriage return
+	}
+	return len(r.delimiter) - 1
+}
+
+// suffix returns the last n bytes (or fewer) of tail and chunk put
+// together
+func (r *lineReader) suffix(tail, chunk []byte, n int) []byte {
+	if len(chunk) >= n {
+		return chunk[len(chunk)-n:]
+	}
+	s := append(append([]byte{}, tail...), chunk...)
+	if len(s) > n {
+		s = s[len(s)-n:]
+	}
+	return s
+}
+
+// write writes tail and chunk to b, except for their last n bytes,
+// which are returned in a new slice
+func (r *lineReader) write(b *strings.Builder, tail, chunk []byte, n int) []byte {
+	if len(chunk) >= n {
+		b.Write(tail)
+		b.Write(chunk[:len(chunk)-n])
+		return append([]byte{}, chunk[len(chunk)-n:]...)
+	}
 
-	// Out of the reader loop. If at this point we have no buffer,
-	// that means we have no buffer, so we should quit.
-	if b.GetLinesCount() == 0 {
-		b.ExitWith(1)
-		fmt.Fprintf(os.Stderr, "No buffer to work with was available")
+	s := append(append([]byte{}, tail...), chunk...)
+	if len(s) < n {
+		return s
+	}
+	b.Write(s[:len(s)-n])
+	return s[len(s)-n:]
+}
+
+// WaitInputReady blocks until any of the readers receives something
+// from its input, and returns true. It returns false if all of the
+// inputs ended without a single line
+func WaitInputReady(readers []*BufferReader) bool {
+	ready := make(chan bool, len(readers))
+	for _, r := range readers {
+		go func(r *BufferReader) {
+			_, ok := <-r.InputReadyCh()
+			ready <- ok
+		}(r)
+	}
+
+	for range readers {
+		if <-ready {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitInputDone blocks until all of the readers have read their
+// inputs to the end
+func WaitInputDone(readers []*BufferReader) {
+	for _, r := range readers {
+		for range r.InputReadyCh() {
+		}
 	}
 }
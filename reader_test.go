@@ -1,9 +1,11 @@
 package peco
 
 import (
+	"bufio"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -35,7 +37,171 @@ func TestReader(t *testing.T) {
 	ctx.AddWaitGroup(1)
 	rdr.Loop()
 
-	if len(ctx.lines) != 3 {
-		t.Errorf("Expected 3 lines from input, only got %d", len(ctx.lines))
+	if l := ctx.GetLinesCount(); l != 3 {
+		t.Errorf("Expected 3 lines from input, only got %d", l)
+	}
+}
+
+func TestReaderSources(t *testing.T) {
+	ctx := NewCtx(nil)
+	inputs := map[string]string{
+		"foo.txt": "foo 1\nfoo 2\n",
+		"bar.txt": "bar 1\n",
+		"-":       "",
+	}
+
+	readers := []*BufferReader{}
+	for name, content := range inputs {
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader(content)))
+		rdr.SetSource(name)
+		readers = append(readers, rdr)
+		ctx.AddWaitGroup(1)
+		go rdr.Loop()
+	}
+
+	if !WaitInputReady(readers) {
+		t.Fatalf("Expected some input to be ready")
+	}
+	WaitInputDone(readers)
+
+	lines := ctx.GetLines()
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines from all inputs, got %d", len(lines))
+	}
+	for _, l := range lines {
+		if !strings.Contains(inputs[l.Source()], l.Buffer()+"\n") {
+			t.Errorf("Line '%s' has the wrong source '%s'", l.Buffer(), l.Source())
+		}
+	}
+
+	empty := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("")))
+	ctx.AddWaitGroup(1)
+	go empty.Loop()
+	if WaitInputReady([]*BufferReader{empty}) {
+		t.Errorf("Expected an empty input not to be ready")
+	}
+}
+
+func TestReaderDelimiter(t *testing.T) {
+	tests := []struct {
+		delimiter string
+		input     string
+		expected  []string
+	}{
+		{"", "foo\r\nbar\n\nbaz", []string{"foo", "bar", "baz"}},
+		{"\x00", "with\nnewline\x00plain\x00\x00last", []string{"with\nnewline", "plain", "", "last"}},
+		{"--", "a--b\r\n--c--", []string{"a", "b\r\n", "c"}},
+	}
+
+	for _, test := range tests {
+		ctx := NewCtx(nil)
+		ctx.SetInputDelimiter(test.delimiter)
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader(test.input)))
+		ctx.AddWaitGroup(1)
+		go rdr.Loop()
+		WaitInputDone([]*BufferReader{rdr})
+
+		got := []string{}
+		for _, l := range ctx.GetLines() {
+			got = append(got, l.Buffer())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Delimiter %q: expected lines %q, got %q", test.delimiter, test.expected, got)
+		}
+	}
+}
+
+func TestReaderIndex(t *testing.T) {
+	ctx := NewCtx(nil)
+	rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("zero\n\ntwo\nthree\n")))
+	ctx.AddWaitGroup(1)
+	go rdr.Loop()
+	WaitInputDone([]*BufferReader{rdr})
+
+	lines := ctx.GetLines()
+	expected := []int{0, 2, 3}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i, l := range lines {
+		if l.Index() != expected[i] {
+			t.Errorf("Line '%s': expected index %d, got %d", l.Buffer(), expected[i], l.Index())
+		}
+	}
+
+	// Matching keeps the ID and the index of the line
+	results, err := ctx.MatchLines("t", lines)
+	if err != nil {
+		t.Fatalf("Failed to match: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 matches, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.ID() != lines[i+1].ID() || r.Index() != lines[i+1].Index() {
+			t.Errorf("Match '%s': expected ID %d and index %d, got %d and %d", r.Buffer(), lines[i+1].ID(), lines[i+1].Index(), r.ID(), r.Index())
+		}
+	}
+}
+
+func TestReaderLongLines(t *testing.T) {
+	long := strings.Repeat("x", 200*1024)
+	huge := strings.Repeat("y", hugeLineSize+1)
+	input := "short\n" + long + "\n" + huge + "\nlast"
+
+	ctx := NewCtx(nil)
+	rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader(input)))
+	ctx.AddWaitGroup(1)
+	go rdr.Loop()
+	WaitInputDone([]*BufferReader{rdr})
+
+	lines := ctx.GetLines()
+	expected := []string{"short", long, huge, "last"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i, l := range lines {
+		if l.Buffer() != expected[i] {
+			t.Errorf("Line %d: expected %d bytes, got %d", i, len(expected[i]), len(l.Buffer()))
+		}
+	}
+
+	select {
+	case r := <-ctx.StatusMsgCh():
+		if msg := r.data.(StatusMsgRequest).message; !strings.HasPrefix(msg, "Warning") {
+			t.Errorf("Expected a warning about the huge line, got '%s'", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for a warning about the huge line")
+	}
+}
+
+func TestLineReaderSplitDelimiter(t *testing.T) {
+	// With the smallest buffer, delimiters and carriage returns are
+	// split between the chunks that the lines are read in
+	long := strings.Repeat("0123456789", 5)
+	tests := []struct {
+		delimiter string
+		input     string
+		expected  []string
+	}{
+		{"", long + "\r\n" + long + "\n\r\nlast\r", []string{long, long, "", "last"}},
+		{"--", long + "--a-b--" + long + "-", []string{long, "a-b", long + "-"}},
+		{"<->", "123456789012345<->x<-<->", []string{"123456789012345", "x<-"}},
+	}
+
+	for _, test := range tests {
+		r := &lineReader{bufio.NewReaderSize(strings.NewReader(test.input), 16), test.delimiter}
+		got := []string{}
+		for {
+			line, err := r.ReadLine()
+			if err != nil {
+				break
+			}
+			got = append(got, line)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Delimiter %q: expected lines %q, got %q", test.delimiter, test.expected, got)
+		}
 	}
 }
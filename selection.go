@@ -1,78 +1,65 @@
 package peco
 
 import (
-	"math/big"
+	"sort"
 	"sync"
 )
 
-// Selection stores the line numbers that were selected by the user.
-// The contents of the Selection is always sorted from smallest to
-// largest line number
+// Selection stores the lines that were selected by the user. Lines
+// are kept by their IDs (see Line.ID), so that they stay selected
+// when the query changes, even if they are not displayed anymore
 type Selection struct {
-	selection *big.Int // bitmask
-	flipped   uint64
+	selection map[uint64]Line
 	mutex     sync.Locker
 }
 
 // NewSelection creates a new empty Selection
 func NewSelection() *Selection {
-	return &Selection{&big.Int{}, 0, newMutex()}
+	return &Selection{map[uint64]Line{}, newMutex()}
 }
 
-// Invert inverts the selection - if items 2 and 3 are selected out of
-// 10 items, then items 1 and items 4 to 10 are selected after call
-// to this method
-func (s *Selection) Invert(pad int) {
-	dst := (&big.Int{}).Set(s.selection)
-	for i := 0; i < pad; i++ {
-		b := dst.Bit(i)
-		if b == 1 {
-			b = 0
+// Invert inverts the selection of `lines` - if lines 2 and 3 are
+// selected out of 10 lines, then lines 1 and 4 to 10 are selected
+// after call to this method. Lines that are not given are left alone
+func (s *Selection) Invert(lines []Line) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, l := range lines {
+		if _, ok := s.selection[l.ID()]; ok {
+			delete(s.selection, l.ID())
 		} else {
-			b = 1
-		}
-		dst.SetBit(dst, i, b)
-		if b == 1 {
-			s.flipped++
+			s.selection[l.ID()] = l
 		}
 	}
-
-	s.selection = dst
 }
 
-// Has returns true if line `v` is in the selection
-func (s Selection) Has(v int) bool {
+// Has returns true if line `l` is in the selection
+func (s Selection) Has(l Line) bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	return s.selection.Bit(v) == 1
+	_, ok := s.selection[l.ID()]
+	return ok
 }
 
-// Add adds a new line number to the selection. If the line already
-// exists in the selection, it is silently ignored
-func (s *Selection) Add(v int) {
-	if s.Has(v) {
-		return
-	}
-
+// Add adds a new line to the selection. If the line already exists
+// in the selection, it is silently ignored
+func (s *Selection) Add(l Line) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.flipped++
-	s.selection = s.selection.SetBit(s.selection, v, 1)
-}
-
-// Remove removes the specified line number from the selection
-func (s *Selection) Remove(v int) {
-	if ! s.Has(v) {
-		return
+	if _, ok := s.selection[l.ID()]; !ok {
+		s.selection[l.ID()] = l
 	}
+}
 
+// Remove removes the specified line from the selection
+func (s *Selection) Remove(l Line) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.flipped--
-	s.selection = s.selection.SetBit(s.selection, v, 0)
+	delete(s.selection, l.ID())
 }
 
 // Clear empties the selection
@@ -80,11 +67,41 @@ func (s *Selection) Clear() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.flipped = 0
-	s.selection = &big.Int{}
+	s.selection = map[uint64]Line{}
 }
 
 // Len returns the number of elements in the selection.
 func (s Selection) Len() uint64 {
-	return s.flipped
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return uint64(len(s.selection))
+}
+
+// Lines returns the selected lines, in the order in which they were
+// read
+func (s Selection) Lines() []Line {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lines := make([]Line, 0, len(s.selection))
+	for _, l := range s.selection {
+		lines = append(lines, l)
+	}
+	sort.Sort(byID(lines))
+	return lines
+}
+
+type byID []Line
+
+func (b byID) Len() int {
+	return len(b)
+}
+
+func (b byID) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byID) Less(i, j int) bool {
+	return b[i].ID() < b[j].ID()
 }
@@ -0,0 +1,10 @@
+// +build !windows
+
+package peco
+
+import "os/exec"
+
+// shellCommand creates a command that runs `command` with the shell
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
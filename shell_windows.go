@@ -0,0 +1,15 @@
+package peco
+
+import (
+	"os"
+	"os/exec"
+)
+
+// shellCommand creates a command that runs `command` with the shell
+func shellCommand(command string) *exec.Cmd {
+	shell := os.Getenv("COMSPEC")
+	if shell == "" {
+		shell = "cmd"
+	}
+	return exec.Command(shell, "/c", command)
+}
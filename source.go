@@ -0,0 +1,168 @@
+package peco
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/text/encoding"
+)
+
+var errNoSourceCommand = errors.New("nothing to reload, as peco was not started with --source-command")
+
+// SourceCommand produces the lines of the buffer by running a command
+// (--source-command), instead of reading them from a file or Stdin.
+// The command can be run again to reload the buffer (peco.Reload)
+type SourceCommand struct {
+	command string
+	mutex   sync.Locker
+	running io.Closer // the output of the command run by Start
+}
+
+// NewSourceCommand creates a new SourceCommand. The command is run by
+// the shell, so it may contain pipes and such
+func NewSourceCommand(command string) *SourceCommand {
+	return &SourceCommand{command, newMutex(), nil}
+}
+
+// commandOutput is the Stdout of a running command. Closing it also
+// kills and waits for the command, so that it doesn't stay around as a
+// zombie. It may be closed more than once
+type commandOutput struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	once *sync.Once
+}
+
+func (o commandOutput) Close() error {
+	var err error
+	o.once.Do(func() {
+		err = o.ReadCloser.Close()
+		if p := o.cmd.Process; p != nil {
+			p.Kill()
+		}
+		o.cmd.Wait()
+	})
+	return err
+}
+
+// Start runs the command, and returns its output, so that the first
+// lines can be displayed while the command is still running
+func (s *SourceCommand) Start() (io.ReadCloser, error) {
+	cmd := shellCommand(s.command)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o := commandOutput{out, cmd, &sync.Once{}}
+	s.running = o
+	return o, nil
+}
+
+// ReadLines runs the command, and returns all of its output, converted
+// from the named encoding (see --input-encoding) and split at each
+// delimiter (see --input-delimiter), along with the encoding that was
+// used. Empty lines are skipped, unless a delimiter is given. As with
+// custom matchers, a non-zero exit status is only an error if the
+// command printed something to its Stderr
+func (s *SourceCommand) ReadLines(enableSep bool, delimiter, encodingName string) ([]Line, encoding.Encoding, error) {
+	out, err := shellCommand(s.command).Output()
+	if err != nil {
+		if err = processError("source command", err); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	input, enc, err := decodeInput(bytes.NewReader(out), encodingName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := []Line{}
+	reader := newLineReader(input, delimiter)
+	for index := 0; ; index++ {
+		line, err := reader.ReadLine()
+		if err != nil {
+			break
+		}
+		if line != "" || delimiter != "" {
+			l := NewRawLine(line, enableSep)
+			l.index = index
+			lines = append(lines, l)
+		}
+	}
+	return lines, enc, nil
+}
+
+// Reload runs the source command again, and replaces the buffer with
+// its output. The current query is then run against the new lines
+func (c *Ctx) Reload() error {
+	if c.source == nil {
+		return errNoSourceCommand
+	}
+
+	// Only one reload at a time, so that the buffer is replaced with
+	// the output of the commands in the order in which they were run
+	c.source.mutex.Lock()
+	defer c.source.mutex.Unlock()
+
+	lines, enc, err := c.source.ReadLines(c.enableSep, c.InputDelimiter(), c.InputEncoding())
+	if err != nil {
+		return err
+	}
+
+	// The command that was started first may still be running. It is
+	// stopped, and its reader stops adding lines once they are replaced
+	if c.source.running != nil {
+		c.source.running.Close()
+		c.source.running = nil
+	}
+	c.setSourceEncoding("", enc)
+	c.SetLines(lines)
+
+	// The selected lines are not in the new buffer
+	c.SelectionClear()
+	if !c.ExecQuery() {
+		c.DrawMatches(c.GetLines())
+	}
+	return nil
+}
+
+// Reloader reloads the buffer every interval (--reload-interval)
+type Reloader struct {
+	*Ctx
+	interval time.Duration
+}
+
+// NewReloader creates a new Reloader
+func (c *Ctx) NewReloader(interval time.Duration) *Reloader {
+	return &Reloader{c, interval}
+}
+
+// Loop keeps reloading the buffer until peco exits. Errors are
+// displayed in the status bar, and the previous lines are kept
+func (r *Reloader) Loop() {
+	defer r.ReleaseWaitGroup()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.LoopCh():
+			return
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				r.SendStatusMsg(err.Error())
+			}
+		}
+	}
+}
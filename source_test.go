@@ -0,0 +1,165 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceCommandReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	ctx := NewCtx(nil)
+	if err := ctx.Reload(); err != errNoSourceCommand {
+		t.Errorf("Expected an error without a source command, got %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "peco-source")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "input")
+
+	ctx.SetSourceCommand(NewSourceCommand("cat " + file))
+	for _, content := range []string{"foo\nbar\n", "foo\nbar\nbaz\n"} {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write input: %s", err)
+		}
+		if err := ctx.Reload(); err != nil {
+			t.Fatalf("Reload failed: %s", err)
+		}
+		<-ctx.DrawCh()
+
+		got := ""
+		for _, l := range ctx.GetLines() {
+			got += l.Buffer() + "\n"
+		}
+		if got != content {
+			t.Errorf("Expected lines %q, got %q", content, got)
+		}
+	}
+
+	// A failing command leaves the buffer alone
+	ctx.SetSourceCommand(NewSourceCommand("echo oops >&2; exit 1"))
+	if err := ctx.Reload(); err == nil || err.Error() != "source command: oops" {
+		t.Errorf("Expected the error from the command, got %v", err)
+	}
+	if l := ctx.GetLinesCount(); l != 3 {
+		t.Errorf("Expected the previous 3 lines to be kept, got %d", l)
+	}
+}
+
+func TestSourceCommandDelimiter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	// Empty records are kept, but empty lines are not
+	tests := []struct {
+		delimiter string
+		expected  []string
+	}{
+		{"", []string{"a", "b"}},
+		{"\n", []string{"a", "", "b"}},
+	}
+	for _, test := range tests {
+		lines, _, err := NewSourceCommand(`printf 'a\n\nb\n'`).ReadLines(false, test.delimiter, "")
+		if err != nil {
+			t.Fatalf("ReadLines failed: %s", err)
+		}
+		got := []string{}
+		for _, l := range lines {
+			got = append(got, l.Buffer())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Delimiter %q: expected lines %q, got %q", test.delimiter, test.expected, got)
+		}
+	}
+}
+
+func TestSourceCommandStart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	out, err := NewSourceCommand("echo foo; echo bar").Start()
+	if err != nil {
+		t.Fatalf("Failed to start command: %s", err)
+	}
+	b, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatalf("Failed to read output: %s", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Errorf("Failed to close output: %s", err)
+	}
+	if string(b) != "foo\nbar\n" {
+		t.Errorf("Expected output %q, got %q", "foo\nbar\n", string(b))
+	}
+}
+
+func TestSourceCommandReloadWhileRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-source")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "reloaded")
+
+	ctx := NewCtx(nil)
+	drainChannels(ctx, nil)
+	defer ctx.Stop()
+
+	// The first run is still going when the buffer is reloaded
+	source := NewSourceCommand("if [ -f " + marker + " ]; then echo new; else echo old; sleep 2; echo stale; fi")
+	in, err := source.Start()
+	if err != nil {
+		t.Fatalf("Failed to start command: %s", err)
+	}
+	rdr := ctx.NewBufferReader(in)
+	ctx.AddWaitGroup(1)
+	go rdr.Loop()
+	if !WaitInputReady([]*BufferReader{rdr}) {
+		t.Fatalf("Expected some input to be ready")
+	}
+
+	ctx.SetSourceCommand(source)
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatalf("Failed to write marker: %s", err)
+	}
+	start := time.Now()
+	if err := ctx.Reload(); err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+	WaitInputDone([]*BufferReader{rdr})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected the first command to be stopped, but it ran for %s", d)
+	}
+
+	got := []string{}
+	for _, l := range ctx.GetLines() {
+		got = append(got, l.Buffer())
+	}
+	if !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("Expected only the reloaded lines, got %q", got)
+	}
+
+	// Lines from a reader of the replaced buffer are dropped
+	old := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("")))
+	ctx.SetLines(nil)
+	if old.appendLineSince(NewRawLine("stale", false), old.replaced) {
+		t.Errorf("Expected a line from before SetLines to be dropped")
+	}
+}
@@ -0,0 +1,304 @@
+package peco
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// walkConcurrency is the number of directories that are read at the
+// same time, each by a goroutine of its own. Reading directories mostly
+// waits for the disk, so this doesn't depend on the number of CPUs
+const walkConcurrency = 16
+
+// Walker lists the files under some directories (--walk), so that peco
+// can be used as a file picker without find(1). Directories are read
+// concurrently, and the paths are fed to the buffer as they are found.
+// Files that are ignored by .gitignore files, and hidden files, are
+// skipped
+type Walker struct {
+	roots   []string
+	include []ignorePattern
+	exclude []ignorePattern
+	hidden  bool
+}
+
+// NewWalker creates a new Walker for the directories. The current
+// directory is walked if there are none
+func NewWalker(roots []string) *Walker {
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	return &Walker{roots: roots}
+}
+
+// SetInclude makes the walker only list the files that match any of
+// the globs (--walk-include). Globs without a slash are matched against
+// the name of the file, others against its path under the directory
+// that is walked
+func (w *Walker) SetInclude(globs []string) error {
+	patterns, err := parseGlobs(globs)
+	if err != nil {
+		return err
+	}
+	w.include = patterns
+	return nil
+}
+
+// SetExclude makes the walker skip the files and directories that
+// match any of the globs (--walk-exclude)
+func (w *Walker) SetExclude(globs []string) error {
+	patterns, err := parseGlobs(globs)
+	if err != nil {
+		return err
+	}
+	w.exclude = patterns
+	return nil
+}
+
+// SetHidden makes the walker list hidden files, and walk into hidden
+// directories (--walk-hidden). .git directories are always skipped
+func (w *Walker) SetHidden(b bool) {
+	w.hidden = b
+}
+
+// parseGlobs parses the globs as patterns relative to the directory
+// that is walked. Their base is filled in for each directory
+func parseGlobs(globs []string) ([]ignorePattern, error) {
+	patterns := []ignorePattern{}
+	for _, g := range globs {
+		if _, err := filepath.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob '%s': %s", g, err)
+		}
+		if p, ok := parseIgnorePattern(g, ""); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, nil
+}
+
+// walk is a single run of a Walker. A fixed number of workers take the
+// directories to read from the queue, and add their subdirectories to
+// it, until there are none left
+type walk struct {
+	*Walker
+	delimiter []byte
+	out       *io.PipeWriter
+	outMutex  sync.Locker
+	done      chan struct{}
+	doneOnce  *sync.Once
+
+	queue   []walkDir
+	pending int // directories that are queued or being read
+	cond    *sync.Cond
+}
+
+// walkDir is a directory to be read. path is the path that is output,
+// which is relative if the directory given to the walker was
+type walkDir struct {
+	path    string
+	abs     string
+	ignores []ignorePattern
+	include []ignorePattern
+	exclude []ignorePattern
+}
+
+// Start starts walking, and returns the paths that are found, each
+// followed by the delimiter (or a newline if it is empty). Paths that
+// contain the delimiter are skipped. Closing the output stops the walk
+func (w *Walker) Start(delimiter string) (io.ReadCloser, error) {
+	if delimiter == "" {
+		delimiter = "\n"
+	}
+
+	dirs := []walkDir{}
+	for _, root := range w.roots {
+		fi, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", root)
+		}
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, walkDir{
+			path:    root,
+			abs:     abs,
+			ignores: parentIgnores(abs),
+			include: rebase(w.include, abs),
+			exclude: rebase(w.exclude, abs),
+		})
+	}
+
+	r, out := io.Pipe()
+	k := &walk{
+		Walker:    w,
+		delimiter: []byte(delimiter),
+		out:       out,
+		outMutex:  newMutex(),
+		done:      make(chan struct{}),
+		doneOnce:  &sync.Once{},
+		cond:      sync.NewCond(newMutex()),
+	}
+	for _, d := range dirs {
+		k.push(d)
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < walkConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				d, ok := k.pop()
+				if !ok {
+					return
+				}
+				k.walkDir(d)
+				k.finish()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		out.Close()
+	}()
+	return r, nil
+}
+
+// push adds a directory to the queue
+func (k *walk) push(d walkDir) {
+	k.cond.L.Lock()
+	defer k.cond.L.Unlock()
+	k.queue = append(k.queue, d)
+	k.pending++
+	k.cond.Signal()
+}
+
+// pop takes the directory that was queued last, so that the directories
+// are mostly walked depth first, which keeps the queue short. It waits
+// for a directory to be queued while others are still being read, and
+// returns false once all of them have been read
+func (k *walk) pop() (walkDir, bool) {
+	k.cond.L.Lock()
+	defer k.cond.L.Unlock()
+	for len(k.queue) == 0 && k.pending > 0 {
+		k.cond.Wait()
+	}
+	if len(k.queue) == 0 {
+		return walkDir{}, false
+	}
+	d := k.queue[len(k.queue)-1]
+	k.queue = k.queue[:len(k.queue)-1]
+	return d, true
+}
+
+// finish marks a directory that was taken from the queue as read
+func (k *walk) finish() {
+	k.cond.L.Lock()
+	defer k.cond.L.Unlock()
+	k.pending--
+	if k.pending == 0 {
+		k.cond.Broadcast()
+	}
+}
+
+// rebase returns the patterns, relative to the directory base
+func rebase(patterns []ignorePattern, base string) []ignorePattern {
+	rebased := make([]ignorePattern, len(patterns))
+	for i, p := range patterns {
+		p.base = base
+		rebased[i] = p
+	}
+	return rebased
+}
+
+func (k *walk) stopped() bool {
+	select {
+	case <-k.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// walkDir outputs the files in the directory, and queues each of its
+// subdirectories
+func (k *walk) walkDir(d walkDir) {
+	if k.stopped() {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(d.abs)
+	ignores := d.ignores
+	if patterns := readIgnoreFile(d.abs); len(patterns) > 0 {
+		// Copied, as the parent's patterns are shared with its other
+		// subdirectories
+		ignores = append(ignores[:len(ignores):len(ignores)], patterns...)
+	}
+	if err != nil {
+		// Directories that can't be read are skipped, as with find
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	for _, fi := range entries {
+		name := fi.Name()
+		if name == ".git" || (!k.hidden && strings.HasPrefix(name, ".")) {
+			continue
+		}
+
+		abs := filepath.Join(d.abs, name)
+		isDir := fi.IsDir()
+		if isIgnored(ignores, abs, isDir) || matchAny(d.exclude, abs, isDir) {
+			continue
+		}
+
+		p := filepath.Join(d.path, name)
+		if isDir {
+			k.push(walkDir{p, abs, ignores, d.include, d.exclude})
+			continue
+		}
+
+		if len(d.include) > 0 && !matchAny(d.include, abs, false) {
+			continue
+		}
+		if bytes.Contains([]byte(p), k.delimiter) {
+			continue
+		}
+		buf.WriteString(p)
+		buf.Write(k.delimiter)
+	}
+	k.write(buf.Bytes())
+}
+
+// write outputs the paths of a directory at once, so that they aren't
+// mixed up with those of other directories
+func (k *walk) write(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	k.outMutex.Lock()
+	defer k.outMutex.Unlock()
+	if _, err := k.out.Write(b); err != nil {
+		// The output was closed, so there's no point in going on
+		k.doneOnce.Do(func() { close(k.done) })
+	}
+}
+
+func matchAny(patterns []ignorePattern, abs string, isDir bool) bool {
+	for _, p := range patterns {
+		if p.match(abs, isDir) {
+			return true
+		}
+	}
+	return false
+}
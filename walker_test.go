@@ -0,0 +1,124 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWalker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-walk")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".git/HEAD":               "",
+		".gitignore":              "*.log\n/build/\n!keep.log\n",
+		".hidden/secret.go":       "",
+		".env":                    "",
+		"main.go":                 "",
+		"debug.log":               "",
+		"keep.log":                "",
+		"build/out.go":            "",
+		"src/build/gen.go":        "",
+		"src/app/.gitignore":      "*_test.go\n",
+		"src/app/app.go":          "",
+		"src/app/app_test.go":     "",
+		"src/app/vendor/lib.go":   "",
+		"docs/README.md":          "",
+		"docs/deep/nested/doc.go": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory for %s: %s", name, err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	walk := func(roots []string, include, exclude []string, hidden bool) []string {
+		w := NewWalker(roots)
+		w.SetHidden(hidden)
+		if err := w.SetInclude(include); err != nil {
+			t.Fatalf("Failed to set include globs: %s", err)
+		}
+		if err := w.SetExclude(exclude); err != nil {
+			t.Fatalf("Failed to set exclude globs: %s", err)
+		}
+		r, err := w.Start("")
+		if err != nil {
+			t.Fatalf("Failed to start walking: %s", err)
+		}
+		defer r.Close()
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Failed to read paths: %s", err)
+		}
+
+		paths := []string{}
+		for _, p := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+			if p == "" {
+				continue
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				t.Fatalf("Failed to make %s relative: %s", p, err)
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	tests := []struct {
+		name     string
+		roots    []string
+		include  []string
+		exclude  []string
+		hidden   bool
+		expected []string
+	}{
+		{
+			"default", []string{dir}, nil, nil, false,
+			[]string{"docs/README.md", "docs/deep/nested/doc.go", "keep.log", "main.go", "src/app/app.go", "src/app/vendor/lib.go", "src/build/gen.go"},
+		},
+		{
+			"hidden", []string{dir}, nil, nil, true,
+			[]string{".env", ".gitignore", ".hidden/secret.go", "docs/README.md", "docs/deep/nested/doc.go", "keep.log", "main.go", "src/app/.gitignore", "src/app/app.go", "src/app/vendor/lib.go", "src/build/gen.go"},
+		},
+		{
+			"include", []string{dir}, []string{"*.go"}, nil, false,
+			[]string{"docs/deep/nested/doc.go", "main.go", "src/app/app.go", "src/app/vendor/lib.go", "src/build/gen.go"},
+		},
+		{
+			"exclude", []string{dir}, []string{"*.go"}, []string{"vendor", "docs/**/nested"}, false,
+			[]string{"main.go", "src/app/app.go", "src/build/gen.go"},
+		},
+		{
+			// The .gitignore of the repository applies below it
+			"subdirectory", []string{filepath.Join(dir, "src", "app")}, nil, nil, false,
+			[]string{"src/app/app.go", "src/app/vendor/lib.go"},
+		},
+	}
+
+	for _, test := range tests {
+		if got := walk(test.roots, test.include, test.exclude, test.hidden); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+
+	if _, err := NewWalker([]string{filepath.Join(dir, "main.go")}).Start(""); err == nil {
+		t.Errorf("Expected walking a file to fail")
+	}
+	if err := NewWalker(nil).SetInclude([]string{"[oops"}); err == nil {
+		t.Errorf("Expected an invalid glob to be rejected")
+	}
+}